@@ -1,6 +1,10 @@
 package config
 
-import "github.com/vrischmann/envconfig"
+import (
+	"time"
+
+	"github.com/vrischmann/envconfig"
+)
 
 var Env struct {
 	MongoDB struct {
@@ -8,8 +12,103 @@ var Env struct {
 		Database string `envconfig:"default=meal-maker-db"`
 	}
 
+	App struct {
+		// "development" libera os provedores de teste, que não entregam nada
+		// e escrevem os códigos no log
+		Environment string `envconfig:"default=production"`
+	}
+
 	Auth struct {
-		SecretKey string `envconfig:"default=your-secret-key"`
+		SecretKey       string        `envconfig:"default=your-secret-key"`
+		AccessTokenTTL  time.Duration `envconfig:"default=15m"`
+		RefreshTokenTTL time.Duration `envconfig:"default=720h"`
+	}
+
+	Password struct {
+		// Algoritmo usado para gerar os hashes de senha: "bcrypt" ou "argon2id"
+		Hasher        string `envconfig:"default=bcrypt"`
+		BcryptCost    int    `envconfig:"default=12"`
+		Argon2Time    int    `envconfig:"default=3"`
+		Argon2Memory  int    `envconfig:"default=65536"`
+		Argon2Threads int    `envconfig:"default=2"`
+	}
+
+	Proxy struct {
+		// Endereços (IPs ou CIDRs, separados por espaço) que podem informar o
+		// IP do cliente. O host do Functions repassa as requisições pelo loopback;
+		// vazio faz o IP ser sempre o da conexão.
+		TrustedProxies string `envconfig:"default=127.0.0.1 ::1"`
+		// Cabeçalho com o IP do cliente. Só o último endereço que não é de um
+		// proxy confiável é usado, e esse é o que o front-end acrescentou.
+		ClientIPHeader string `envconfig:"default=X-Forwarded-For"`
+	}
+
+	RateLimit struct {
+		PhoneMaxAttempts int           `envconfig:"default=5"`
+		IPMaxAttempts    int           `envconfig:"default=20"`
+		Window           time.Duration `envconfig:"default=15m"`
+		BaseLockout      time.Duration `envconfig:"default=1m"`
+		MaxLockout       time.Duration `envconfig:"default=1h"`
+	}
+
+	OTP struct {
+		TTL              time.Duration `envconfig:"default=5m"`
+		MaxAttempts      int           `envconfig:"default=5"`
+		ResendInterval   time.Duration `envconfig:"default=60s"`
+		RequiredOnSignUp bool          `envconfig:"default=false"`
+	}
+
+	PasswordReset struct {
+		TTL time.Duration `envconfig:"default=30m"`
+		// Página do app que recebe o token, ex: https://app.mealmaker.com.br/nova-senha
+		URL string `envconfig:"optional"`
+	}
+
+	Notifier struct {
+		// Provedor usado para enviar SMS/WhatsApp. "log" apenas escreve no log
+		// e só vale em desenvolvimento; sem provedor o envio fica desativado.
+		Provider string `envconfig:"optional"`
+	}
+
+	Partner struct {
+		// Fuso IANA usado para parceiros sem fuso configurado
+		DefaultTimezone string `envconfig:"default=America/Sao_Paulo"`
+	}
+
+	Idempotency struct {
+		// Por quanto tempo uma Idempotency-Key devolve a resposta original
+		Window time.Duration `envconfig:"default=24h"`
+	}
+
+	Stream struct {
+		// Intervalo de consulta quando o Mongo não tem change streams (sem replica set)
+		PollInterval      time.Duration `envconfig:"default=3s"`
+		HeartbeatInterval time.Duration `envconfig:"default=15s"`
+	}
+
+	Tracking struct {
+		// Página pública de acompanhamento, ex: https://app.mealmaker.com.br/acompanhar
+		URL                  string        `envconfig:"optional"`
+		LinkTTLAfterDelivery time.Duration `envconfig:"default=1h"`
+	}
+
+	Scheduling struct {
+		// Antecedência mínima e máxima de um pedido agendado
+		MinLeadTime time.Duration `envconfig:"default=30m"`
+		MaxAdvance  time.Duration `envconfig:"default=168h"`
+		// Tamanho das faixas de horário usadas no limite de pedidos por faixa
+		SlotDuration time.Duration `envconfig:"default=30m"`
+		// Quanto tempo antes do horário agendado o pedido entra no feed da cozinha
+		FeedLeadTime time.Duration `envconfig:"default=45m"`
+	}
+
+	Payment struct {
+		// Provedor que confirma os pagamentos PIX. Sem provedor o PIX fica fora
+		// das formas de pagamento aceitas. "fake" aceita webhooks assinados com
+		// WebhookSecret e só vale em desenvolvimento.
+		Provider      string        `envconfig:"optional"`
+		ChargeTTL     time.Duration `envconfig:"default=30m"`
+		WebhookSecret string        `envconfig:"optional"`
 	}
 
 	Azure struct {
@@ -19,6 +118,11 @@ var Env struct {
 	}
 }
 
+// IsDevelopment diz se a aplicação está rodando localmente (APP_ENVIRONMENT=development).
+func IsDevelopment() bool {
+	return Env.App.Environment == "development"
+}
+
 func Init() error {
 	return envconfig.Init(&Env)
 }
@@ -5,7 +5,9 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
+	_ "time/tzdata"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -22,10 +24,18 @@ func initRoutes(router *gin.Engine) {
 		log.Fatalf("Falha ao obter as variáveis de ambiente internas: %s", err)
 	}
 
+	// Sem isso o gin aceita X-Forwarded-For de qualquer cliente, e o limite de
+	// tentativas por IP pode ser contornado trocando o cabeçalho
+	err = router.SetTrustedProxies(strings.Fields(config.Env.Proxy.TrustedProxies))
+	if err != nil {
+		log.Fatalf("Proxies confiáveis inválidos, %s\n", err)
+	}
+	router.RemoteIPHeaders = []string{config.Env.Proxy.ClientIPHeader}
+
 	MONGODB_URL := config.Env.MongoDB.URL
 	MONGODB_DATABASE := config.Env.MongoDB.Database
 
-	_, database, err := database.GetConnection(ctx, database.MongodbConfig{
+	_, db, err := database.GetConnection(ctx, database.MongodbConfig{
 		ConnectionURL: MONGODB_URL,
 		Database:      MONGODB_DATABASE,
 	})
@@ -34,56 +44,132 @@ func initRoutes(router *gin.Engine) {
 		return
 	}
 
-	h := handlers.NewHandlers(ctx, database)
+	err = database.EnsureIndexes(ctx, db)
+	if err != nil {
+		log.Fatalf("Não foi possível criar os índices do MongoDB, %s\n", err)
+		return
+	}
+
+	err = database.EnsureSequences(ctx, db)
+	if err != nil {
+		log.Fatalf("Não foi possível iniciar as sequências de id do MongoDB, %s\n", err)
+		return
+	}
+
+	h, err := handlers.NewHandlers(ctx, db)
+	if err != nil {
+		log.Fatalf("Configuração inválida, %s\n", err)
+		return
+	}
 
 	router.Use(cors.New(cors.Config{
 		AllowMethods:     []string{"GET", "POST", "OPTIONS", "PUT"},
-		AllowHeaders:     []string{"Origin", "Authorization", "Content-Type", "Content-Length", "User-Agent", "Host", "Referrer"},
-		ExposeHeaders:    []string{"Content-Length"},
+		AllowHeaders:     []string{"Origin", "Authorization", "Content-Type", "Content-Length", "User-Agent", "Host", "Referrer", "Idempotency-Key", "Last-Event-ID"},
+		ExposeHeaders:    []string{"Content-Length", "Idempotent-Replayed"},
 		AllowCredentials: true,
 		AllowAllOrigins:  false,
 		AllowOriginFunc:  func(origin string) bool { return true },
 		MaxAge:           12 * time.Hour,
 	}))
 
+	auth := h.AuthenticateMiddleware
+	authorize := handlers.AuthorizeMiddleware
+
 	api := router.Group("/api")
 	{
 		// BFF
 		api.GET("/get-bff/:partner_id", h.GetBFFByPartnerId)
 
 		// Users
-		api.GET("/get-users", handlers.AuthenticateMiddleware, h.GetUsers)
-		api.GET("/get-user/:user_id", handlers.AuthenticateMiddleware, h.GetUserById)
-		api.POST("/update-user-password/:phone_number", handlers.AuthenticateMiddleware, h.UpdatePassword)
-		api.PATCH("/update-user-address/:user_id", handlers.AuthenticateMiddleware, h.UpdateUserAddress)
+		api.GET("/get-users", auth, authorize(handlers.RoleAdmin), h.GetUsers)
+		api.GET("/get-user/:user_id", auth, authorize(handlers.RoleClient, handlers.RoleAdmin), h.GetUserById)
+		api.POST("/update-user-password/:phone_number", auth, authorize(handlers.RoleClient, handlers.RolePartner, handlers.RoleCourier, handlers.RoleAdmin), h.UpdatePassword)
+		api.PATCH("/update-user-address/:user_id", auth, authorize(handlers.RoleClient, handlers.RoleAdmin), h.UpdateUserAddress)
+		api.GET("/get-user-addresses/:user_id", auth, authorize(handlers.RoleClient, handlers.RoleAdmin), h.GetUserAddresses)
+		api.POST("/create-user-address/:user_id", auth, authorize(handlers.RoleClient, handlers.RoleAdmin), h.CreateUserAddress)
+		api.PATCH("/update-user-address/:user_id/:address_id", auth, authorize(handlers.RoleClient, handlers.RoleAdmin), h.UpdateUserAddressByID)
+		api.PATCH("/set-default-user-address/:user_id/:address_id", auth, authorize(handlers.RoleClient, handlers.RoleAdmin), h.SetDefaultUserAddress)
+		api.DELETE("/delete-user-address/:user_id/:address_id", auth, authorize(handlers.RoleClient, handlers.RoleAdmin), h.DeleteUserAddress)
+		api.GET("/export-user-data/:user_id", auth, authorize(handlers.RoleClient, handlers.RoleAdmin), h.ExportUserData)
+		api.DELETE("/delete-user/:user_id", auth, authorize(handlers.RoleClient, handlers.RoleAdmin), h.DeleteAccount)
+		api.PATCH("/update-user-role/:user_id", auth, authorize(handlers.RoleAdmin), h.UpdateUserRole)
+		api.GET("/get-security-events", auth, authorize(handlers.RoleAdmin), h.GetSecurityEvents)
+		api.GET("/me", auth, h.GetUserById)
+		api.DELETE("/me", auth, h.DeleteAccount)
+		api.GET("/me/data-export", auth, h.ExportUserData)
+		api.PATCH("/me/address", auth, h.UpdateUserAddress)
+		api.POST("/me/password", auth, h.UpdatePassword)
+		api.GET("/me/addresses", auth, h.GetUserAddresses)
+		api.POST("/me/addresses", auth, h.CreateUserAddress)
+		api.PATCH("/me/addresses/:address_id", auth, h.UpdateUserAddressByID)
+		api.PATCH("/me/addresses/:address_id/default", auth, h.SetDefaultUserAddress)
+		api.DELETE("/me/addresses/:address_id", auth, h.DeleteUserAddress)
 		api.POST("/sign-up", h.SignUp)
 		api.POST("/sign-in", h.SignIn)
+		api.POST("/sign-in/otp", h.SignInWithOTP)
+		api.POST("/otp/request", h.RequestOTP)
+		api.POST("/otp/verify", h.VerifyOTP)
+		api.POST("/password-reset/request", h.RequestPasswordReset)
+		api.POST("/password-reset/confirm", h.ConfirmPasswordReset)
+		api.POST("/refresh-token", h.RefreshToken)
+		api.POST("/sign-out", auth, h.SignOut)
+		api.POST("/sign-out-all", auth, h.SignOutAllDevices)
 
 		// Orders
-		api.GET("/get-orders-by-partner/:partner_id", h.GetOrdersByPartnerID)
-		api.GET("/get-orders-by-user/:user_id", h.GetOrdersByUserID)
-		api.POST("/create-order/:user_id", h.CreateOrderByUser)
-		api.PATCH("/update-order/:order_id", h.UpdateOrderByUser)
+		api.GET("/get-orders-by-partner/:partner_id", auth, authorize(handlers.RolePartner, handlers.RoleCourier, handlers.RoleAdmin), h.GetOrdersByPartnerID)
+		api.GET("/get-orders-by-user/:user_id", auth, authorize(handlers.RoleClient, handlers.RoleAdmin), h.GetOrdersByUserID)
+		api.POST("/create-order/:user_id", auth, authorize(handlers.RoleClient, handlers.RoleAdmin), h.CreateOrderByUser)
+		api.GET("/me/orders", auth, authorize(handlers.RoleClient, handlers.RoleAdmin), h.GetOrdersByUserID)
+		api.POST("/me/orders", auth, authorize(handlers.RoleClient, handlers.RoleAdmin), h.CreateOrderByUser)
+		api.PATCH("/update-order/:order_id", auth, authorize(handlers.RoleClient, handlers.RolePartner, handlers.RoleCourier, handlers.RoleAdmin), h.UpdateOrderByUser)
+		api.PATCH("/cancel-order/:order_id", auth, authorize(handlers.RoleClient, handlers.RolePartner, handlers.RoleAdmin), h.CancelOrder)
+		api.GET("/stream-order/:order_id", auth, authorize(handlers.RoleClient, handlers.RolePartner, handlers.RoleAdmin), h.StreamOrderByID)
+		api.GET("/get-order-tracking-link/:order_id", auth, authorize(handlers.RoleClient, handlers.RolePartner, handlers.RoleAdmin), h.GetOrderTrackingLink)
+		api.GET("/get-order-tracking/:token", h.GetOrderTracking)
+		api.GET("/stream-order-tracking/:token", h.StreamOrderTracking)
+		api.GET("/stream-orders-by-partner/:partner_id", auth, authorize(handlers.RolePartner, handlers.RoleAdmin), h.GetOrdersStreamByPartnerID)
+		api.GET("/get-orders-report/:partner_id", auth, authorize(handlers.RolePartner, handlers.RoleAdmin), h.GetOrdersReportByPartnerID)
+
+		// Payments
+		api.POST("/create-order-pix/:order_id", auth, authorize(handlers.RoleClient, handlers.RolePartner, handlers.RoleAdmin), h.CreateOrderPixCharge)
+		api.GET("/get-order-pix-qrcode/:order_id", auth, authorize(handlers.RoleClient, handlers.RolePartner, handlers.RoleAdmin), h.GetOrderPixQRCode)
+		api.POST("/payment-webhook", h.PaymentWebhook)
+		api.PATCH("/update-partner-payment-methods/:partner_id", auth, authorize(handlers.RolePartner, handlers.RoleAdmin), h.UpdatePartnerPaymentMethods)
+
+		// Coupons
+		api.GET("/get-coupons/:partner_id", auth, authorize(handlers.RolePartner, handlers.RoleAdmin), h.GetCouponsByPartnerID)
+		api.POST("/create-coupon/:partner_id", auth, authorize(handlers.RolePartner, handlers.RoleAdmin), h.CreateCoupon)
+		api.PATCH("/update-coupon/:partner_id/:coupon_id", auth, authorize(handlers.RolePartner, handlers.RoleAdmin), h.UpdateCoupon)
+		api.DELETE("/delete-coupon/:partner_id/:coupon_id", auth, authorize(handlers.RolePartner, handlers.RoleAdmin), h.DeleteCoupon)
 
 		// Dish
+		// Pratos, acompanhamentos e entregadores são compartilhados entre os
+		// parceiros (não têm partner_id), então só o admin pode alterá-los
 		api.GET("/get-dishes", h.GetDishes)
 		api.GET("/get-dish/:id", h.GetDishBydId)
-		api.POST("/create-dish", h.CreateDish)
-		api.POST("/upload-image", h.UploadImage)
-		api.PATCH("/update-dish/:id", h.UpdateDish)
-		api.DELETE("/delete-dish/:id", h.DeleteDish)
+		api.POST("/create-dish", auth, authorize(handlers.RoleAdmin), h.CreateDish)
+		api.POST("/upload-image", auth, authorize(handlers.RolePartner, handlers.RoleAdmin), h.UploadImage)
+		api.PATCH("/update-dish/:id", auth, authorize(handlers.RoleAdmin), h.UpdateDish)
+		api.DELETE("/delete-dish/:id", auth, authorize(handlers.RoleAdmin), h.DeleteDish)
+
+		// Menu
+		api.GET("/get-menus/:partner_id", h.GetMenusByPartnerId)
+		api.GET("/get-menu/:menu_id", h.GetMenuById)
+		api.POST("/create-menu/:partner_id", auth, authorize(handlers.RolePartner, handlers.RoleAdmin), h.CreateMenuByPartnerID)
+		api.PATCH("/update-menu/:partner_id/:menu_id", auth, authorize(handlers.RolePartner, handlers.RoleAdmin), h.UpdateMenuByID)
+		api.DELETE("/delete-menu/:partner_id/:menu_id", auth, authorize(handlers.RolePartner, handlers.RoleAdmin), h.DeleteMenuByID)
 
 		// Accompaniment
 		api.GET("/get-accompaniments", h.GetAccompaniments)
-		api.POST("/create-accompaniments", h.CreateAccompaniments)
-		api.PATCH("/update-accompaniments", h.UpdateAccompaniments)
-		api.DELETE("/delete-accompaniment/:accompaniment_id", h.DeleteAccompanimentById)
+		api.POST("/create-accompaniments", auth, authorize(handlers.RoleAdmin), h.CreateAccompaniments)
+		api.PATCH("/update-accompaniments", auth, authorize(handlers.RoleAdmin), h.UpdateAccompaniments)
+		api.DELETE("/delete-accompaniment/:accompaniment_id", auth, authorize(handlers.RoleAdmin), h.DeleteAccompanimentById)
 
 		// Delivery Man
-		api.GET("/get-deliveries", h.GetDeliveries)
-		api.POST("/create-delivery", h.CreateDelivery)
-		api.PATCH("/update-delivery/:delivery_id", h.UpdateDeliveryByID)
-		api.DELETE("/delete-delivery/:delivery_id", h.DeleteDeliveryByID)
+		api.GET("/get-deliveries", auth, authorize(handlers.RolePartner, handlers.RoleAdmin), h.GetDeliveries)
+		api.POST("/create-delivery", auth, authorize(handlers.RoleAdmin), h.CreateDelivery)
+		api.PATCH("/update-delivery/:delivery_id", auth, authorize(handlers.RoleAdmin), h.UpdateDeliveryByID)
+		api.DELETE("/delete-delivery/:delivery_id", auth, authorize(handlers.RoleAdmin), h.DeleteDeliveryByID)
 
 		api.GET("/health-check", func(c *gin.Context) {
 			c.Header("Content-Type", "application/json")
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	_ "time/tzdata"
+
+	"github.com/sergingroisman/meal-maker-functions/cmd/config"
+	"github.com/sergingroisman/meal-maker-functions/database"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Tarefas de manutenção da base, executadas uma vez por ambiente:
+//
+//	go run ./cmd/migrate seed-sequences
+//	go run ./cmd/migrate convert-dates
+//	go run ./cmd/migrate convert-money
+//	go run ./cmd/migrate normalize-phones
+var tasks = map[string]func(ctx context.Context, db *mongo.Database) error{
+	"seed-sequences":   seedSequences,
+	"convert-dates":    convertDates,
+	"convert-money":    convertMoney,
+	"normalize-phones": normalizePhones,
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "uso: %s <tarefa>\n\ntarefas:\n", os.Args[0])
+		for name := range tasks {
+			fmt.Fprintf(os.Stderr, "  %s\n", name)
+		}
+	}
+	flag.Parse()
+
+	task, ok := tasks[flag.Arg(0)]
+	if !ok {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+	err := config.Init()
+	if err != nil {
+		log.Fatalf("Falha ao obter as variáveis de ambiente internas: %s", err)
+	}
+
+	client, db, err := database.GetConnection(ctx, database.MongodbConfig{
+		ConnectionURL: config.Env.MongoDB.URL,
+		Database:      config.Env.MongoDB.Database,
+	})
+	if err != nil {
+		log.Fatalf("Não foi possível estabelecer uma conexão com o MongoDB, %s\n", err)
+	}
+	defer client.Disconnect(ctx)
+
+	if err := task(ctx, db); err != nil {
+		log.Fatalf("Tarefa %s falhou: %s", flag.Arg(0), err)
+	}
+	log.Printf("Tarefa %s concluída", flag.Arg(0))
+}
+
+// seedSequences inicializa a collection Counters a partir do maior _id de cada
+// collection com id sequencial.
+func seedSequences(ctx context.Context, db *mongo.Database) error {
+	for _, name := range database.Sequences {
+		seq, err := database.SeedSequence(ctx, db, name)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		log.Printf("Sequência %s iniciada em %d", name, seq)
+	}
+	return nil
+}
+
+// convertDates troca as datas gravadas como texto por datas BSON.
+func convertDates(ctx context.Context, db *mongo.Database) error {
+	for _, name := range database.DatedCollections {
+		converted, err := database.ConvertStringDates(ctx, db, name)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		log.Printf("%s: %d documentos convertidos", name, converted)
+	}
+	return nil
+}
+
+// convertMoney troca os valores em reais (float) por centavos (inteiro).
+func convertMoney(ctx context.Context, db *mongo.Database) error {
+	for name := range database.MoneyFields {
+		converted, err := database.ConvertMoneyFields(ctx, db, name)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		log.Printf("%s: %d documentos convertidos", name, converted)
+	}
+	return nil
+}
+
+// normalizePhones grava os telefones dos usuários no formato usado no login e
+// lista os usuários que precisam ser resolvidos à mão.
+func normalizePhones(ctx context.Context, db *mongo.Database) error {
+	report, err := database.NormalizeUserPhoneNumbers(ctx, db)
+	if err != nil {
+		return err
+	}
+	log.Printf("Users: %d telefones normalizados", report.Converted)
+	for phone_number, ids := range report.Collisions {
+		log.Printf("Colisão em %s, usuários não alterados: %v", phone_number, ids)
+	}
+	for _, id := range report.Invalid {
+		log.Printf("Telefone inválido, usuário não alterado: %s", id.Hex())
+	}
+	if len(report.Collisions) > 0 || len(report.Invalid) > 0 {
+		return fmt.Errorf("%d colisões e %d telefones inválidos para resolver", len(report.Collisions), len(report.Invalid))
+	}
+	return nil
+}
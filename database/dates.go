@@ -0,0 +1,110 @@
+package database
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// DatedCollections são as collections que já gravaram created_at/updated_at
+// como texto (time.Now().String()).
+var DatedCollections = []string{
+	"Users", "Partners", "Dishes", "Accompaniments", "Menus", "Orders",
+	"Deliveries", "Sessions", "OneTimeCodes", "PasswordResets", "SecurityEvents",
+}
+
+var legacyDateFields = map[string]bool{
+	"created_at": true,
+	"updated_at": true,
+}
+
+const legacyTimeLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// ParseLegacyTime lê uma data gravada com time.Now().String(), que inclui o
+// sufixo monotônico "m=+25.33".
+func ParseLegacyTime(value string) (time.Time, error) {
+	if i := strings.Index(value, " m="); i >= 0 {
+		value = value[:i]
+	}
+	return time.Parse(legacyTimeLayout, value)
+}
+
+// ConvertStringDates troca por datas BSON os created_at/updated_at em texto de
+// todos os documentos da collection, inclusive nos documentos embutidos (o
+// usuário copiado no pedido, os acompanhamentos dos pratos). Retorna quantos
+// documentos foram alterados. Datas que não puderem ser lidas ficam como estão.
+func ConvertStringDates(ctx context.Context, database *mongo.Database, name string) (int, error) {
+	collection := database.Collection(name)
+	cursor, err := collection.Find(ctx, bson.D{})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	converted := 0
+	for cursor.Next(ctx) {
+		var doc bson.D
+		if err := cursor.Decode(&doc); err != nil {
+			return converted, err
+		}
+		if !convertDates(doc) {
+			continue
+		}
+		var id interface{}
+		for _, field := range doc {
+			if field.Key == "_id" {
+				id = field.Value
+				break
+			}
+		}
+		_, err := collection.ReplaceOne(ctx, bson.D{{Key: "_id", Value: id}}, doc)
+		if err != nil {
+			return converted, err
+		}
+		converted++
+	}
+	return converted, cursor.Err()
+}
+
+func convertDates(value interface{}) bool {
+	changed := false
+	switch v := value.(type) {
+	case bson.D:
+		for i, field := range v {
+			if text, ok := field.Value.(string); ok && legacyDateFields[field.Key] {
+				if parsed, err := ParseLegacyTime(text); err == nil {
+					v[i].Value = parsed
+					changed = true
+				}
+				continue
+			}
+			if convertDates(field.Value) {
+				changed = true
+			}
+		}
+	case bson.M:
+		for key, field := range v {
+			if text, ok := field.(string); ok && legacyDateFields[key] {
+				if parsed, err := ParseLegacyTime(text); err == nil {
+					v[key] = parsed
+					changed = true
+				}
+				continue
+			}
+			if convertDates(field) {
+				changed = true
+			}
+		}
+	case primitive.A:
+		for _, item := range v {
+			if convertDates(item) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
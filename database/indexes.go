@@ -0,0 +1,88 @@
+package database
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// indexes lista os índices que a aplicação precisa em cada collection.
+// CreateMany é idempotente, então é seguro rodar em todo cold start.
+var indexes = map[string][]mongo.IndexModel{
+	"AuthAttempts": {
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	},
+	"Coupons": {
+		{
+			Keys:    bson.D{{Key: "partner_id", Value: 1}, {Key: "code", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+	},
+	"IdempotencyKeys": {
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	},
+	"OneTimeCodes": {
+		{Keys: bson.D{{Key: "phone_number", Value: 1}, {Key: "purpose", Value: 1}}},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	},
+	"Orders": {
+		// Usado pelo polling dos streams de pedidos quando não há change streams
+		{Keys: bson.D{{Key: "partner_id", Value: 1}, {Key: "status_history.changed_at", Value: 1}}},
+		// Listagens paginadas por parceiro e por cliente
+		{Keys: bson.D{{Key: "partner_id", Value: 1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "user._id", Value: 1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}},
+		// Webhooks de pagamento localizam o pedido pela cobrança
+		{Keys: bson.D{{Key: "payment.charge_id", Value: 1}}},
+		// Pedidos agendados para o dia na listagem do parceiro
+		{Keys: bson.D{{Key: "partner_id", Value: 1}, {Key: "scheduled_for", Value: 1}}},
+		// Pedidos agendados que entram no stream da cozinha ao passar o visible_at
+		{Keys: bson.D{{Key: "partner_id", Value: 1}, {Key: "visible_at", Value: 1}}},
+	},
+	"PasswordResets": {
+		{Keys: bson.D{{Key: "token_hash", Value: 1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	},
+	"ScheduleSlots": {
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	},
+	"SecurityEvents": {
+		{Keys: bson.D{{Key: "phone_number", Value: 1}}},
+		{Keys: bson.D{{Key: "ip", Value: 1}}},
+	},
+	"Sessions": {
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+		{Keys: bson.D{{Key: "refresh_token_hash", Value: 1}}},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	},
+}
+
+func EnsureIndexes(ctx context.Context, database *mongo.Database) error {
+	for collection, models := range indexes {
+		_, err := database.Collection(collection).Indexes().CreateMany(ctx, models)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package database
+
+import (
+	"context"
+	"math"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// MoneyFields são os campos de valor que eram gravados como float64 em reais e
+// passam a ser inteiros em centavos. Caminhos com ponto entram nos documentos
+// embutidos, inclusive dentro de arrays (os pratos do pedido).
+var MoneyFields = map[string][]string{
+	"Dishes":   {"price", "discount"},
+	"Partners": {"delivery_fee"},
+	"Orders": {
+		"subtotal", "discount", "delivery_fee", "total",
+		"dishes.price", "dishes.line_total", "discounts.amount",
+	},
+	"Coupons": {"amount", "min_order_value"},
+	// Cardápios antigos guardam cópias dos pratos
+	"Menus": {"dishes.price", "dishes.discount"},
+}
+
+// ConvertMoneyFields converte para centavos os campos de MoneyFields[name] de
+// todos os documentos da collection e retorna quantos foram alterados. Só
+// valores double (gravados pelo float64) ou int32 (importados de JSON) são
+// convertidos; os int64 já estão em centavos, então rodar de novo não altera
+// nada.
+func ConvertMoneyFields(ctx context.Context, database *mongo.Database, name string) (int, error) {
+	collection := database.Collection(name)
+	cursor, err := collection.Find(ctx, bson.D{})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	converted := 0
+	for cursor.Next(ctx) {
+		var doc bson.D
+		if err := cursor.Decode(&doc); err != nil {
+			return converted, err
+		}
+		changed := false
+		for _, path := range MoneyFields[name] {
+			if convertMoney(doc, strings.Split(path, ".")) {
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		var id interface{}
+		for _, field := range doc {
+			if field.Key == "_id" {
+				id = field.Value
+				break
+			}
+		}
+		_, err := collection.ReplaceOne(ctx, bson.D{{Key: "_id", Value: id}}, doc)
+		if err != nil {
+			return converted, err
+		}
+		converted++
+	}
+	return converted, cursor.Err()
+}
+
+func convertMoney(value interface{}, path []string) bool {
+	changed := false
+	switch v := value.(type) {
+	case bson.D:
+		for i, field := range v {
+			if field.Key != path[0] {
+				continue
+			}
+			if len(path) > 1 {
+				return convertMoney(field.Value, path[1:])
+			}
+			switch reais := field.Value.(type) {
+			case float64:
+				v[i].Value = int64(math.Round(reais * 100))
+				return true
+			case int32:
+				v[i].Value = int64(reais) * 100
+				return true
+			}
+			return false
+		}
+	case primitive.A:
+		for _, item := range v {
+			if convertMoney(item, path) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
@@ -0,0 +1,95 @@
+package database
+
+import (
+	"context"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// NormalizePhoneNumber mantém apenas os dígitos e aceita DDD + número (10 ou
+// 11 dígitos), removendo o código do país quando informado.
+func NormalizePhoneNumber(phone_number string) (string, bool) {
+	var digits strings.Builder
+	for _, r := range phone_number {
+		if r >= '0' && r <= '9' {
+			digits.WriteRune(r)
+		}
+	}
+
+	normalized := digits.String()
+	if strings.HasPrefix(normalized, "55") && (len(normalized) == 12 || len(normalized) == 13) {
+		normalized = normalized[2:]
+	}
+
+	if len(normalized) != 10 && len(normalized) != 11 {
+		return "", false
+	}
+	return normalized, true
+}
+
+// PhoneNumbersReport é o resultado de NormalizeUserPhoneNumbers. Collisions
+// agrupa por número normalizado os usuários que passariam a ter o mesmo
+// telefone; Invalid são os usuários com um número que não pôde ser lido.
+type PhoneNumbersReport struct {
+	Converted  int
+	Collisions map[string][]primitive.ObjectID
+	Invalid    []primitive.ObjectID
+}
+
+// NormalizeUserPhoneNumbers grava os telefones dos usuários no formato
+// normalizado usado no login. Usuários em colisão ou com número inválido
+// ficam como estão e vão para o relatório, para serem resolvidos à mão.
+func NormalizeUserPhoneNumbers(ctx context.Context, database *mongo.Database) (PhoneNumbersReport, error) {
+	report := PhoneNumbersReport{Collisions: map[string][]primitive.ObjectID{}}
+
+	collection := database.Collection("Users")
+	opts := options.Find().SetProjection(bson.D{{Key: "phone_number", Value: 1}})
+	cursor, err := collection.Find(ctx, bson.D{}, opts)
+	if err != nil {
+		return report, err
+	}
+	defer cursor.Close(ctx)
+
+	type storedPhone struct {
+		ID          primitive.ObjectID `bson:"_id"`
+		PhoneNumber string             `bson:"phone_number"`
+	}
+	users_by_phone := map[string][]storedPhone{}
+	for cursor.Next(ctx) {
+		var user storedPhone
+		if err := cursor.Decode(&user); err != nil {
+			return report, err
+		}
+		normalized, ok := NormalizePhoneNumber(user.PhoneNumber)
+		if !ok {
+			report.Invalid = append(report.Invalid, user.ID)
+			continue
+		}
+		users_by_phone[normalized] = append(users_by_phone[normalized], user)
+	}
+	if err := cursor.Err(); err != nil {
+		return report, err
+	}
+
+	for normalized, users := range users_by_phone {
+		if len(users) > 1 {
+			for _, user := range users {
+				report.Collisions[normalized] = append(report.Collisions[normalized], user.ID)
+			}
+			continue
+		}
+		if users[0].PhoneNumber == normalized {
+			continue
+		}
+		update := bson.D{{Key: "$set", Value: bson.D{{Key: "phone_number", Value: normalized}}}}
+		if _, err := collection.UpdateOne(ctx, bson.D{{Key: "_id", Value: users[0].ID}}, update); err != nil {
+			return report, err
+		}
+		report.Converted++
+	}
+	return report, nil
+}
@@ -0,0 +1,70 @@
+package database
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const countersCollection = "Counters"
+
+// Sequences são as collections que usam _id inteiro sequencial. O nome da
+// sequência é o próprio nome da collection.
+var Sequences = []string{"Orders", "Deliveries"}
+
+type counter struct {
+	ID  string `bson:"_id"`
+	Seq int    `bson:"seq"`
+}
+
+// NextSequence reserva o próximo valor da sequência de forma atômica. Como o
+// contador fica no Mongo, o valor é único entre todas as instâncias.
+func NextSequence(ctx context.Context, database *mongo.Database, name string) (int, error) {
+	var c counter
+	filter := bson.D{{Key: "_id", Value: name}}
+	update := bson.D{{Key: "$inc", Value: bson.D{{Key: "seq", Value: 1}}}}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	err := database.Collection(countersCollection).FindOneAndUpdate(ctx, filter, update, opts).Decode(&c)
+	if err != nil {
+		return 0, err
+	}
+	return c.Seq, nil
+}
+
+// SeedSequence alinha a sequência com o maior _id já gravado na collection.
+// Usa $max, então nunca faz a sequência voltar.
+func SeedSequence(ctx context.Context, database *mongo.Database, name string) (int, error) {
+	var last struct {
+		ID int `bson:"_id"`
+	}
+	opts := options.FindOne().SetSort(bson.D{{Key: "_id", Value: -1}}).SetProjection(bson.D{{Key: "_id", Value: 1}})
+	filter := bson.D{{Key: "_id", Value: bson.D{{Key: "$type", Value: "number"}}}}
+	err := database.Collection(name).FindOne(ctx, filter, opts).Decode(&last)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, err
+	}
+
+	var c counter
+	update := bson.D{{Key: "$max", Value: bson.D{{Key: "seq", Value: last.ID}}}}
+	update_opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	err = database.Collection(countersCollection).FindOneAndUpdate(ctx, bson.D{{Key: "_id", Value: name}}, update, update_opts).Decode(&c)
+	if err != nil {
+		return 0, err
+	}
+	return c.Seq, nil
+}
+
+// EnsureSequences alinha todas as sequências com os ids já gravados. Como
+// SeedSequence é idempotente, é seguro rodar em todo cold start, junto com
+// EnsureIndexes.
+func EnsureSequences(ctx context.Context, database *mongo.Database) error {
+	for _, name := range Sequences {
+		if _, err := SeedSequence(ctx, database, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
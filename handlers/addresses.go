@@ -0,0 +1,482 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// UserAddress é um endereço do caderno de endereços do cliente. O endereço
+// padrão também fica copiado em User.Address para os clientes antigos.
+type UserAddress struct {
+	ID        primitive.ObjectID `bson:"_id" json:"_id"`
+	Label     string             `bson:"label" json:"label"`
+	Reference string             `bson:"reference" json:"reference"`
+	IsDefault bool               `bson:"is_default" json:"is_default"`
+	Address   `bson:",inline"`
+}
+
+type UserAddressReqBody struct {
+	Label      string `bson:"label" json:"label" validate:"required,max=30"`
+	Street     string `bson:"street" json:"street" validate:"required"`
+	Number     string `bson:"number" json:"number" validate:"required"`
+	City       string `bson:"city" json:"city" validate:"required"`
+	CEP        string `bson:"cep" json:"cep" validate:"required"`
+	State      string `bson:"state" json:"state"`
+	Complement string `bson:"complement" json:"complement"`
+	Reference  string `bson:"reference" json:"reference" validate:"max=120"`
+	IsDefault  bool   `bson:"is_default" json:"is_default"`
+}
+
+var errAddressNotFound = errors.New("address not found")
+
+func (body UserAddressReqBody) toUserAddress(id primitive.ObjectID) UserAddress {
+	return UserAddress{
+		ID:        id,
+		Label:     body.Label,
+		Reference: body.Reference,
+		IsDefault: body.IsDefault,
+		Address: Address{
+			Street:     body.Street,
+			Number:     body.Number,
+			City:       body.City,
+			CEP:        body.CEP,
+			State:      body.State,
+			Complement: body.Complement,
+		},
+	}
+}
+
+func (h *Handlers) GetUserAddresses(c *gin.Context) {
+	user_id, ok := resolveUserID(c)
+	if !ok {
+		return
+	}
+
+	user, err := h.loadAddressBook(user_id)
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusNotFound, gin.H{
+			"status_code": http.StatusNotFound,
+			"message":     "Não foi possível encontrar esse usuário",
+		})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, user.Addresses)
+}
+
+func (h *Handlers) CreateUserAddress(c *gin.Context) {
+	user_id, ok := resolveUserID(c)
+	if !ok {
+		return
+	}
+
+	body, ok := bindUserAddress(c)
+	if !ok {
+		return
+	}
+
+	user, err := h.loadAddressBook(user_id)
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusNotFound, gin.H{
+			"status_code": http.StatusNotFound,
+			"message":     "Não foi possível encontrar esse usuário",
+		})
+		return
+	}
+
+	address := body.toUserAddress(primitive.NewObjectID())
+	if len(user.Addresses) == 0 {
+		address.IsDefault = true
+	}
+
+	collection := h.database.Collection("Users")
+	filter := bson.D{{Key: "_id", Value: user.ID}}
+	update := bson.D{
+		{Key: "$push", Value: bson.D{{Key: "addresses", Value: address}}},
+		{Key: "$set", Value: bson.D{{Key: "updated_at", Value: time.Now()}}},
+	}
+	_, err = collection.UpdateOne(h.context, filter, update)
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível cadastrar o endereço",
+		})
+		return
+	}
+
+	if address.IsDefault {
+		if err := h.setDefaultAddress(user.ID, address.ID); err != nil {
+			log.Println(err.Error())
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status_code": http.StatusCreated,
+		"address":     address,
+	})
+}
+
+func (h *Handlers) UpdateUserAddressByID(c *gin.Context) {
+	user_id, ok := resolveUserID(c)
+	if !ok {
+		return
+	}
+
+	address_id, ok := addressIDParam(c)
+	if !ok {
+		return
+	}
+
+	body, ok := bindUserAddress(c)
+	if !ok {
+		return
+	}
+
+	if _, err := h.loadAddressBook(user_id); err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusNotFound, gin.H{
+			"status_code": http.StatusNotFound,
+			"message":     "Não foi possível encontrar esse usuário",
+		})
+		return
+	}
+
+	address := body.toUserAddress(address_id)
+
+	collection := h.database.Collection("Users")
+	filter := bson.D{
+		{Key: "_id", Value: user_id},
+		{Key: "addresses._id", Value: address_id},
+	}
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "addresses.$.label", Value: address.Label},
+		{Key: "addresses.$.reference", Value: address.Reference},
+		{Key: "addresses.$.street", Value: address.Street},
+		{Key: "addresses.$.number", Value: address.Number},
+		{Key: "addresses.$.city", Value: address.City},
+		{Key: "addresses.$.cep", Value: address.CEP},
+		{Key: "addresses.$.state", Value: address.State},
+		{Key: "addresses.$.complement", Value: address.Complement},
+		{Key: "updated_at", Value: time.Now()},
+	}}}
+	result, err := collection.UpdateOne(h.context, filter, update)
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível atualizar o endereço",
+		})
+		return
+	}
+	if result.MatchedCount == 0 {
+		respondAddressNotFound(c)
+		return
+	}
+
+	// Mantém User.Address em sincronia quando o endereço editado é o padrão
+	if err := h.syncDefaultAddress(user_id); err != nil {
+		log.Println(err.Error())
+	}
+	if body.IsDefault {
+		if err := h.setDefaultAddress(user_id, address_id); err != nil {
+			log.Println(err.Error())
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status_code": http.StatusOK,
+		"message":     "Endereço atualizado com sucesso",
+	})
+}
+
+func (h *Handlers) DeleteUserAddress(c *gin.Context) {
+	user_id, ok := resolveUserID(c)
+	if !ok {
+		return
+	}
+
+	address_id, ok := addressIDParam(c)
+	if !ok {
+		return
+	}
+
+	user, err := h.loadAddressBook(user_id)
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusNotFound, gin.H{
+			"status_code": http.StatusNotFound,
+			"message":     "Não foi possível encontrar esse usuário",
+		})
+		return
+	}
+
+	address, err := findUserAddress(user, address_id)
+	if err != nil {
+		respondAddressNotFound(c)
+		return
+	}
+
+	collection := h.database.Collection("Users")
+	filter := bson.D{{Key: "_id", Value: user_id}}
+	update := bson.D{
+		{Key: "$pull", Value: bson.D{{Key: "addresses", Value: bson.D{{Key: "_id", Value: address_id}}}}},
+		{Key: "$set", Value: bson.D{{Key: "updated_at", Value: time.Now()}}},
+	}
+	_, err = collection.UpdateOne(h.context, filter, update)
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível deletar o endereço",
+		})
+		return
+	}
+
+	// Ao remover o endereço padrão, o primeiro restante assume o lugar dele
+	if address.IsDefault {
+		for _, remaining := range user.Addresses {
+			if remaining.ID != address_id {
+				if err := h.setDefaultAddress(user_id, remaining.ID); err != nil {
+					log.Println(err.Error())
+				}
+				break
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status_code": http.StatusOK,
+		"message":     "Endereço deletado com sucesso",
+	})
+}
+
+func (h *Handlers) SetDefaultUserAddress(c *gin.Context) {
+	user_id, ok := resolveUserID(c)
+	if !ok {
+		return
+	}
+
+	address_id, ok := addressIDParam(c)
+	if !ok {
+		return
+	}
+
+	if _, err := h.loadAddressBook(user_id); err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusNotFound, gin.H{
+			"status_code": http.StatusNotFound,
+			"message":     "Não foi possível encontrar esse usuário",
+		})
+		return
+	}
+
+	err := h.setDefaultAddress(user_id, address_id)
+	if errors.Is(err, errAddressNotFound) {
+		respondAddressNotFound(c)
+		return
+	}
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível definir o endereço padrão",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status_code": http.StatusOK,
+		"message":     "Endereço padrão atualizado com sucesso",
+	})
+}
+
+// loadAddressBook busca o usuário e, se ele ainda só tiver o endereço único
+// antigo, migra esse endereço para o caderno como padrão.
+func (h *Handlers) loadAddressBook(user_id primitive.ObjectID) (User, error) {
+	var user User
+	collection := h.database.Collection("Users")
+	filter := bson.D{{Key: "_id", Value: user_id}}
+	err := collection.FindOne(h.context, filter).Decode(&user)
+	if err != nil {
+		return user, err
+	}
+
+	if len(user.Addresses) > 0 || user.Address.Street == "" {
+		return user, nil
+	}
+
+	legacy := UserAddress{
+		ID:        primitive.NewObjectID(),
+		Label:     "Casa",
+		IsDefault: true,
+		Address:   user.Address,
+	}
+	migrate_filter := bson.D{
+		{Key: "_id", Value: user.ID},
+		{Key: "addresses.0", Value: bson.D{{Key: "$exists", Value: false}}},
+	}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "addresses", Value: []UserAddress{legacy}}}}}
+	result, err := collection.UpdateOne(h.context, migrate_filter, update)
+	if err != nil {
+		return user, err
+	}
+	if result.ModifiedCount == 0 {
+		// Outra requisição migrou primeiro
+		err = collection.FindOne(h.context, filter).Decode(&user)
+		return user, err
+	}
+
+	user.Addresses = []UserAddress{legacy}
+	return user, nil
+}
+
+// setDefaultAddress marca o endereço como padrão, desmarca os demais e copia
+// o endereço para User.Address.
+func (h *Handlers) setDefaultAddress(user_id, address_id primitive.ObjectID) error {
+	collection := h.database.Collection("Users")
+	filter := bson.D{
+		{Key: "_id", Value: user_id},
+		{Key: "addresses._id", Value: address_id},
+	}
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "addresses.$[].is_default", Value: false},
+	}}}
+	result, err := collection.UpdateOne(h.context, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errAddressNotFound
+	}
+
+	update = bson.D{{Key: "$set", Value: bson.D{
+		{Key: "addresses.$.is_default", Value: true},
+		{Key: "updated_at", Value: time.Now()},
+	}}}
+	_, err = collection.UpdateOne(h.context, filter, update)
+	if err != nil {
+		return err
+	}
+
+	return h.syncDefaultAddress(user_id)
+}
+
+func (h *Handlers) syncDefaultAddress(user_id primitive.ObjectID) error {
+	var user User
+	collection := h.database.Collection("Users")
+	filter := bson.D{{Key: "_id", Value: user_id}}
+	if err := collection.FindOne(h.context, filter).Decode(&user); err != nil {
+		return err
+	}
+
+	address, ok := defaultUserAddress(user)
+	if !ok {
+		return nil
+	}
+
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "address", Value: address.Address}}}}
+	_, err := collection.UpdateOne(h.context, filter, update, options.Update().SetUpsert(false))
+	return err
+}
+
+func defaultUserAddress(user User) (UserAddress, bool) {
+	for _, address := range user.Addresses {
+		if address.IsDefault {
+			return address, true
+		}
+	}
+	if len(user.Addresses) > 0 {
+		return user.Addresses[0], true
+	}
+	return UserAddress{}, false
+}
+
+func findUserAddress(user User, address_id primitive.ObjectID) (UserAddress, error) {
+	for _, address := range user.Addresses {
+		if address.ID == address_id {
+			return address, nil
+		}
+	}
+	return UserAddress{}, errAddressNotFound
+}
+
+func bindUserAddress(c *gin.Context) (UserAddressReqBody, bool) {
+	body := UserAddressReqBody{}
+	if err := c.ShouldBindBodyWithJSON(&body); err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Não foi possível processar esse endereço",
+		})
+		return body, false
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(&body); err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Formulário não está válido",
+		})
+		return body, false
+	}
+
+	return body, true
+}
+
+func addressIDParam(c *gin.Context) (primitive.ObjectID, bool) {
+	address_id, err := primitive.ObjectIDFromHex(c.Param("address_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Formato de ID inválido",
+		})
+		return primitive.NilObjectID, false
+	}
+	return address_id, true
+}
+
+func respondAddressNotFound(c *gin.Context) {
+	c.JSON(http.StatusNotFound, gin.H{
+		"status_code": http.StatusNotFound,
+		"message":     "Endereço não encontrado",
+	})
+}
+
+// resolveOrderAddress escolhe o endereço de entrega do pedido: o address_id
+// informado ou, na falta dele, o endereço padrão do cliente.
+func (h *Handlers) resolveOrderAddress(user_id primitive.ObjectID, address_id_str string) (*UserAddress, error) {
+	user, err := h.loadAddressBook(user_id)
+	if err != nil {
+		return nil, err
+	}
+
+	if address_id_str == "" {
+		address, ok := defaultUserAddress(user)
+		if !ok {
+			return nil, nil
+		}
+		return &address, nil
+	}
+
+	address_id, err := primitive.ObjectIDFromHex(address_id_str)
+	if err != nil {
+		return nil, errAddressNotFound
+	}
+	address, err := findUserAddress(user, address_id)
+	if err != nil {
+		return nil, err
+	}
+	return &address, nil
+}
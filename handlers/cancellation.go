@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	CancelReasonCustomerRequest  = "customer_request"
+	CancelReasonOutOfStock       = "out_of_stock"
+	CancelReasonKitchenClosed    = "kitchen_closed"
+	CancelReasonAddressNotServed = "address_not_served"
+	CancelReasonPaymentIssue     = "payment_issue"
+	CancelReasonDuplicateOrder   = "duplicate_order"
+	CancelReasonOther            = "other"
+)
+
+// OrderCancellation registra quem cancelou o pedido e por quê.
+type OrderCancellation struct {
+	ReasonCode  string    `bson:"reason_code" json:"reason_code"`
+	Reason      string    `bson:"reason" json:"reason"`
+	Actor       string    `bson:"actor" json:"actor"`
+	ActorID     string    `bson:"actor_id" json:"actor_id"`
+	CancelledAt time.Time `bson:"cancelled_at" json:"cancelled_at"`
+}
+
+type OrderCancelReqBody struct {
+	ReasonCode string `bson:"reason_code" json:"reason_code" validate:"required,oneof=customer_request out_of_stock kitchen_closed address_not_served payment_issue duplicate_order other"`
+	Reason     string `bson:"reason" json:"reason" validate:"required_if=ReasonCode other,max=500"`
+}
+
+// CancelOrder cancela o pedido. As regras de quem pode cancelar em cada status
+// são as da máquina de estados: o cliente só enquanto o pedido não foi
+// confirmado e o parceiro até o pedido sair para entrega.
+func (h *Handlers) CancelOrder(c *gin.Context) {
+	order_id_str := c.Param("order_id")
+	if order_id_str == "" {
+		c.IndentedJSON(http.StatusBadRequest, "Necessário passar o id do pedido como parâmetro")
+		return
+	}
+
+	order_id, err := strconv.Atoi(order_id_str)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Formato de ID inválido",
+		})
+		return
+	}
+
+	body := OrderCancelReqBody{}
+	if err := c.ShouldBindBodyWithJSON(&body); err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Não foi possível processar o cancelamento",
+		})
+		return
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(&body); err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Informe um motivo de cancelamento válido",
+		})
+		return
+	}
+
+	order, ok := h.findScopedOrder(c, order_id)
+	if !ok {
+		return
+	}
+
+	auth_user := getAuthUser(c)
+	actor := orderActor(auth_user)
+	if err := checkOrderTransition(order.Status, OrderCancelled, actor); err != nil {
+		respondTransitionError(c, err, order, OrderCancelled)
+		return
+	}
+
+	change := newStatusChange(OrderCancelled, actor, authActorID(auth_user))
+	cancellation := OrderCancellation{
+		ReasonCode:  body.ReasonCode,
+		Reason:      body.Reason,
+		Actor:       change.Actor,
+		ActorID:     change.ActorID,
+		CancelledAt: change.ChangedAt,
+	}
+	err = h.transitionOrder(order, change, bson.D{{Key: "cancellation", Value: cancellation}})
+	if err != nil {
+		respondTransitionError(c, err, order, OrderCancelled)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status_code":  http.StatusOK,
+		"message":      "Pedido cancelado com sucesso",
+		"cancellation": cancellation,
+	})
+}
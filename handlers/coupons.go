@@ -0,0 +1,509 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	CouponPercentage = "percentage"
+	CouponFixed      = "fixed"
+)
+
+// Coupon é um cupom de desconto de um parceiro: Percentage (0-100) nos
+// cupons percentuais e Amount nos de valor fixo. Limites com 0 são ilimitados.
+type Coupon struct {
+	ID              primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	PartnerID       int                `bson:"partner_id" json:"partner_id"`
+	Code            string             `bson:"code" json:"code"`
+	DiscountType    string             `bson:"discount_type" json:"discount_type"`
+	Percentage      float64            `bson:"percentage,omitempty" json:"percentage,omitempty"`
+	Amount          Money              `bson:"amount,omitempty" json:"amount,omitempty"`
+	MinOrderValue   Money              `bson:"min_order_value" json:"min_order_value"`
+	ValidFrom       *time.Time         `bson:"valid_from,omitempty" json:"valid_from,omitempty"`
+	ValidUntil      *time.Time         `bson:"valid_until,omitempty" json:"valid_until,omitempty"`
+	UsageLimit      int                `bson:"usage_limit" json:"usage_limit"`
+	PerUserLimit    int                `bson:"per_user_limit" json:"per_user_limit"`
+	FirstOrderOnly  bool               `bson:"first_order_only" json:"first_order_only"`
+	Active          bool               `bson:"active" json:"active"`
+	RedemptionCount int                `bson:"redemption_count" json:"redemption_count"`
+	CreatedAt       time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt       time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+type CouponReqBody struct {
+	Code           string     `json:"code" validate:"required,alphanum,max=30"`
+	DiscountType   string     `json:"discount_type" validate:"required,oneof=percentage fixed"`
+	Percentage     float64    `json:"percentage" validate:"required_if=DiscountType percentage,min=0,max=100"`
+	Amount         Money      `json:"amount" validate:"required_if=DiscountType fixed,min=0"`
+	MinOrderValue  Money      `json:"min_order_value" validate:"min=0"`
+	ValidFrom      *time.Time `json:"valid_from"`
+	ValidUntil     *time.Time `json:"valid_until"`
+	UsageLimit     int        `json:"usage_limit" validate:"min=0"`
+	PerUserLimit   int        `json:"per_user_limit" validate:"min=0"`
+	FirstOrderOnly bool       `json:"first_order_only"`
+	Active         *bool      `json:"active"`
+}
+
+// CouponError é um cupom que não pode ser usado no pedido; a mensagem vai na
+// resposta 400.
+type CouponError struct {
+	Message string
+}
+
+func (e *CouponError) Error() string {
+	return e.Message
+}
+
+func normalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// discountFor calcula o desconto do cupom sobre o valor dos pratos, já com as
+// promoções. O desconto nunca passa desse valor.
+func (coupon *Coupon) discountFor(amount Money) Money {
+	discount := coupon.Amount
+	if coupon.DiscountType == CouponPercentage {
+		discount = amount.Percent(coupon.Percentage)
+	}
+	return discount.Min(amount)
+}
+
+// applyCoupon valida o cupom para o pedido e inclui o desconto no
+// OrderPricing. Os limites de uso só são garantidos no redeemCoupon.
+func (h *Handlers) applyCoupon(partner_id int, user_id primitive.ObjectID, code string, pricing *OrderPricing, now time.Time) (*Coupon, error) {
+	var coupon Coupon
+	collection := h.database.Collection("Coupons")
+	filter := bson.D{
+		{Key: "partner_id", Value: partner_id},
+		{Key: "code", Value: normalizeCouponCode(code)},
+	}
+	err := collection.FindOne(h.context, filter).Decode(&coupon)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, &CouponError{Message: "Cupom não encontrado"}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !coupon.Active {
+		return nil, &CouponError{Message: "Esse cupom não está mais ativo"}
+	}
+	if coupon.ValidFrom != nil && now.Before(*coupon.ValidFrom) {
+		return nil, &CouponError{Message: "Esse cupom ainda não está valendo"}
+	}
+	if coupon.ValidUntil != nil && now.After(*coupon.ValidUntil) {
+		return nil, &CouponError{Message: "Esse cupom expirou"}
+	}
+	if coupon.UsageLimit > 0 && coupon.RedemptionCount >= coupon.UsageLimit {
+		return nil, &CouponError{Message: "Esse cupom já atingiu o limite de usos"}
+	}
+
+	amount := pricing.Subtotal.Sub(pricing.Discount)
+	if amount < coupon.MinOrderValue {
+		return nil, &CouponError{Message: fmt.Sprintf("Esse cupom vale para pedidos a partir de %s", coupon.MinOrderValue)}
+	}
+
+	if coupon.FirstOrderOnly {
+		first_order, err := h.isFirstOrder(partner_id, user_id)
+		if err != nil {
+			return nil, err
+		}
+		if !first_order {
+			return nil, &CouponError{Message: "Esse cupom vale apenas para o primeiro pedido"}
+		}
+	}
+
+	pricing.addDiscount(OrderDiscount{
+		Source:      DiscountSourceCoupon,
+		Description: "Cupom " + coupon.Code,
+		CouponID:    &coupon.ID,
+		CouponCode:  coupon.Code,
+		Amount:      coupon.discountFor(amount),
+	})
+	return &coupon, nil
+}
+
+// isFirstOrder considera apenas pedidos que não foram cancelados ou recusados.
+func (h *Handlers) isFirstOrder(partner_id int, user_id primitive.ObjectID) (bool, error) {
+	collection := h.database.Collection("Orders")
+	filter := bson.D{
+		{Key: "partner_id", Value: partner_id},
+		{Key: "user._id", Value: user_id},
+		{Key: "status", Value: bson.D{{Key: "$nin", Value: []OrderStatus{OrderCancelled, OrderRejected}}}},
+	}
+	count, err := collection.CountDocuments(h.context, filter, options.Count().SetLimit(1))
+	return count == 0, err
+}
+
+func couponUsageID(coupon_id primitive.ObjectID, user_id primitive.ObjectID) string {
+	return coupon_id.Hex() + ":" + user_id.Hex()
+}
+
+// redeemCoupon conta o uso do cupom de forma atômica. O incremento global só
+// casa enquanto redemption_count está abaixo do limite; o uso por cliente fica
+// em CouponUsages, com o mesmo upsert condicional das faixas de agendamento.
+func (h *Handlers) redeemCoupon(coupon *Coupon, user_id primitive.ObjectID) error {
+	collection := h.database.Collection("Coupons")
+	filter := bson.D{
+		{Key: "_id", Value: coupon.ID},
+		{Key: "active", Value: true},
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "usage_limit", Value: 0}},
+			bson.D{{Key: "$expr", Value: bson.D{{Key: "$lt", Value: bson.A{"$redemption_count", "$usage_limit"}}}}},
+		}},
+	}
+	result, err := collection.UpdateOne(h.context, filter, bson.D{{Key: "$inc", Value: bson.D{{Key: "redemption_count", Value: 1}}}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return &CouponError{Message: "Esse cupom já atingiu o limite de usos"}
+	}
+
+	if coupon.PerUserLimit <= 0 {
+		return nil
+	}
+	collectionU := h.database.Collection("CouponUsages")
+	usage_filter := bson.D{
+		{Key: "_id", Value: couponUsageID(coupon.ID, user_id)},
+		{Key: "count", Value: bson.D{{Key: "$lt", Value: coupon.PerUserLimit}}},
+	}
+	usage_update := bson.D{
+		{Key: "$inc", Value: bson.D{{Key: "count", Value: 1}}},
+		{Key: "$setOnInsert", Value: bson.D{
+			{Key: "coupon_id", Value: coupon.ID},
+			{Key: "user_id", Value: user_id},
+		}},
+	}
+	_, err = collectionU.UpdateOne(h.context, usage_filter, usage_update, options.Update().SetUpsert(true))
+	if err == nil {
+		return nil
+	}
+	h.releaseCouponRedemption(coupon.ID, primitive.NilObjectID)
+	if mongo.IsDuplicateKeyError(err) {
+		return &CouponError{Message: "Você já usou esse cupom o máximo de vezes permitido"}
+	}
+	return err
+}
+
+// releaseCouponRedemption devolve o uso do cupom de um pedido que não foi
+// gravado, foi cancelado ou recusado. Sem user_id só o contador global volta.
+func (h *Handlers) releaseCouponRedemption(coupon_id primitive.ObjectID, user_id primitive.ObjectID) {
+	collection := h.database.Collection("Coupons")
+	filter := bson.D{
+		{Key: "_id", Value: coupon_id},
+		{Key: "redemption_count", Value: bson.D{{Key: "$gt", Value: 0}}},
+	}
+	_, err := collection.UpdateOne(h.context, filter, bson.D{{Key: "$inc", Value: bson.D{{Key: "redemption_count", Value: -1}}}})
+	if err != nil {
+		log.Println("Erro ao devolver o uso do cupom:", err.Error())
+	}
+
+	if user_id.IsZero() {
+		return
+	}
+	collectionU := h.database.Collection("CouponUsages")
+	usage_filter := bson.D{
+		{Key: "_id", Value: couponUsageID(coupon_id, user_id)},
+		{Key: "count", Value: bson.D{{Key: "$gt", Value: 0}}},
+	}
+	_, err = collectionU.UpdateOne(h.context, usage_filter, bson.D{{Key: "$inc", Value: bson.D{{Key: "count", Value: -1}}}})
+	if err != nil {
+		log.Println("Erro ao devolver o uso do cupom do cliente:", err.Error())
+	}
+}
+
+// releaseOrderCoupon devolve o uso do cupom aplicado no pedido, se houver.
+func (h *Handlers) releaseOrderCoupon(order Order) {
+	for _, discount := range order.Discounts {
+		if discount.Source == DiscountSourceCoupon && discount.CouponID != nil {
+			h.releaseCouponRedemption(*discount.CouponID, order.User.ID)
+		}
+	}
+}
+
+// respondCouponError responde 400 com a mensagem de um *CouponError e 500
+// para os demais erros.
+func respondCouponError(c *gin.Context, err error) {
+	var coupon_err *CouponError
+	if errors.As(err, &coupon_err) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     coupon_err.Message,
+		})
+		return
+	}
+	log.Println(err.Error())
+	c.JSON(http.StatusInternalServerError, gin.H{
+		"status_code": http.StatusInternalServerError,
+		"message":     "Não foi possível aplicar o cupom",
+	})
+}
+
+func (h *Handlers) GetCouponsByPartnerID(c *gin.Context) {
+	partner_id, err := strconv.Atoi(c.Param("partner_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Formato de id inválido",
+		})
+		return
+	}
+
+	collection := h.database.Collection("Coupons")
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	cursor, err := collection.Find(h.context, bson.D{{Key: "partner_id", Value: partner_id}}, opts)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, err)
+		return
+	}
+	defer cursor.Close(h.context)
+
+	coupons := make([]Coupon, 0)
+	for cursor.Next(h.context) {
+		var coupon Coupon
+		if err := cursor.Decode(&coupon); err != nil {
+			log.Println(err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status_code": http.StatusInternalServerError,
+				"message":     "Não foi possível processar a lista de cupons",
+			})
+			return
+		}
+		coupons = append(coupons, coupon)
+	}
+
+	c.IndentedJSON(http.StatusOK, coupons)
+}
+
+// bindCouponBody lê e valida o corpo de criação/atualização de cupom,
+// respondendo 400 quando não é válido.
+func bindCouponBody(c *gin.Context) (CouponReqBody, bool) {
+	body := CouponReqBody{}
+	if err := c.ShouldBindBodyWithJSON(&body); err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Não foi possível processar o cupom",
+		})
+		return body, false
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(&body); err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Formulário não está válido",
+		})
+		return body, false
+	}
+
+	if body.ValidFrom != nil && body.ValidUntil != nil && !body.ValidUntil.After(*body.ValidFrom) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "O fim da validade precisa ser depois do início",
+		})
+		return body, false
+	}
+	// Só o campo do tipo escolhido é guardado
+	if body.DiscountType == CouponPercentage {
+		body.Amount = 0
+	} else {
+		body.Percentage = 0
+	}
+	return body, true
+}
+
+func respondDuplicateCoupon(c *gin.Context) {
+	c.JSON(http.StatusConflict, gin.H{
+		"status_code": http.StatusConflict,
+		"message":     "Já existe um cupom com esse código",
+	})
+}
+
+func (h *Handlers) CreateCoupon(c *gin.Context) {
+	partner_id, err := strconv.Atoi(c.Param("partner_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Formato de id inválido",
+		})
+		return
+	}
+
+	body, ok := bindCouponBody(c)
+	if !ok {
+		return
+	}
+
+	active := true
+	if body.Active != nil {
+		active = *body.Active
+	}
+
+	coupon := Coupon{
+		ID:             primitive.NewObjectID(),
+		PartnerID:      partner_id,
+		Code:           normalizeCouponCode(body.Code),
+		DiscountType:   body.DiscountType,
+		Percentage:     body.Percentage,
+		Amount:         body.Amount,
+		MinOrderValue:  body.MinOrderValue,
+		ValidFrom:      body.ValidFrom,
+		ValidUntil:     body.ValidUntil,
+		UsageLimit:     body.UsageLimit,
+		PerUserLimit:   body.PerUserLimit,
+		FirstOrderOnly: body.FirstOrderOnly,
+		Active:         active,
+		CreatedAt:      time.Now(),
+		UpdatedAt:      time.Now(),
+	}
+
+	collection := h.database.Collection("Coupons")
+	_, err = collection.InsertOne(h.context, coupon)
+	if mongo.IsDuplicateKeyError(err) {
+		respondDuplicateCoupon(c)
+		return
+	}
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Cupom não foi criado, ocorreu um erro inesperado",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status_code": http.StatusCreated,
+		"message":     "Cupom criado com sucesso",
+		"coupon":      coupon,
+	})
+}
+
+// UpdateCoupon substitui as regras do cupom. O contador de usos é mantido.
+func (h *Handlers) UpdateCoupon(c *gin.Context) {
+	partner_id, err := strconv.Atoi(c.Param("partner_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Formato de id inválido",
+		})
+		return
+	}
+	coupon_id, err := primitive.ObjectIDFromHex(c.Param("coupon_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Formato de ID inválido",
+		})
+		return
+	}
+
+	body, ok := bindCouponBody(c)
+	if !ok {
+		return
+	}
+
+	update_fields := bson.D{
+		{Key: "code", Value: normalizeCouponCode(body.Code)},
+		{Key: "discount_type", Value: body.DiscountType},
+		{Key: "percentage", Value: body.Percentage},
+		{Key: "amount", Value: body.Amount},
+		{Key: "min_order_value", Value: body.MinOrderValue},
+		{Key: "valid_from", Value: body.ValidFrom},
+		{Key: "valid_until", Value: body.ValidUntil},
+		{Key: "usage_limit", Value: body.UsageLimit},
+		{Key: "per_user_limit", Value: body.PerUserLimit},
+		{Key: "first_order_only", Value: body.FirstOrderOnly},
+		{Key: "updated_at", Value: time.Now()},
+	}
+	if body.Active != nil {
+		update_fields = append(update_fields, bson.E{Key: "active", Value: *body.Active})
+	}
+
+	collection := h.database.Collection("Coupons")
+	filter := bson.D{{Key: "_id", Value: coupon_id}, {Key: "partner_id", Value: partner_id}}
+	result, err := collection.UpdateOne(h.context, filter, bson.D{{Key: "$set", Value: update_fields}})
+	if mongo.IsDuplicateKeyError(err) {
+		respondDuplicateCoupon(c)
+		return
+	}
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível atualizar o cupom",
+		})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status_code": http.StatusNotFound,
+			"message":     "Cupom não encontrado",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status_code": http.StatusOK,
+		"message":     "Cupom atualizado com sucesso",
+	})
+}
+
+func (h *Handlers) DeleteCoupon(c *gin.Context) {
+	partner_id, err := strconv.Atoi(c.Param("partner_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Formato de id inválido",
+		})
+		return
+	}
+	coupon_id, err := primitive.ObjectIDFromHex(c.Param("coupon_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Formato de ID inválido",
+		})
+		return
+	}
+
+	collection := h.database.Collection("Coupons")
+	filter := bson.D{{Key: "_id", Value: coupon_id}, {Key: "partner_id", Value: partner_id}}
+	result, err := collection.DeleteOne(h.context, filter)
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível deletar o cupom",
+		})
+		return
+	}
+	if result.DeletedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status_code": http.StatusNotFound,
+			"message":     "Cupom não encontrado",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status_code": http.StatusOK,
+		"message":     "Cupom deletado com sucesso",
+	})
+}
@@ -1,37 +1,32 @@
 package handlers
 
 import (
-	"fmt"
 	"log"
 	"net/http"
 	"strconv"
-	"strings"
-	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/sergingroisman/meal-maker-functions/database"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type Delivery struct {
-	ID          int    `bson:"_id" json:"_id"`
-	Name        string `bson:"name" json:"name"`
-	PhoneNumber string `bson:"phone_number" json:"phone_number"`
-	CreatedAt   string `bson:"created_at" json:"created_at"`
-	UpdatedAt   string `bson:"updated_at" json:"updated_at"`
+	ID          int       `bson:"_id" json:"_id"`
+	Name        string    `bson:"name" json:"name"`
+	PhoneNumber string    `bson:"phone_number" json:"phone_number"`
+	CreatedAt   time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt   time.Time `bson:"updated_at" json:"updated_at"`
 }
 
+const unknownDeliveryName = "Entregador desconhecido"
+
 type TDeliveryCreateReqBody struct {
 	Name        string `bson:"name" json:"name" validate:"required"`
 	PhoneNumber string `bson:"phone_number" json:"phone_number" validate:"required"`
 }
 
-var (
-	deliveryCounter int
-	counterMutex    sync.Mutex
-)
-
 func (h *Handlers) GetDeliveries(c *gin.Context) {
 	collection := h.database.Collection("Deliveries")
 
@@ -42,14 +37,6 @@ func (h *Handlers) GetDeliveries(c *gin.Context) {
 		return
 	}
 
-	parseCreatedAt := func(dateStr string) (time.Time, error) {
-		parts := strings.Split(dateStr, " ")
-		datePart := parts[0] // "2024-08-02"
-		timePart := parts[1] // "13:58:00.346461603"
-
-		return time.Parse("2006-01-02 15:04:05.999999999", fmt.Sprintf("%s %s", datePart, timePart))
-	}
-
 	deliveries := make([]Delivery, 0)
 	for cursor.Next(h.context) {
 		var delivery Delivery
@@ -62,23 +49,7 @@ func (h *Handlers) GetDeliveries(c *gin.Context) {
 			return
 		}
 
-		createdAt, err := parseCreatedAt(delivery.CreatedAt)
-		if err != nil {
-			log.Println(err.Error())
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"status_code": http.StatusInternalServerError,
-				"message":     "Erro ao converter a data de criação",
-			})
-			return
-		}
-
-		deliveries = append(deliveries, Delivery{
-			ID:          delivery.ID,
-			Name:        delivery.Name,
-			PhoneNumber: delivery.PhoneNumber,
-			CreatedAt:   createdAt.Format("2006-01-02 15:04:05"),
-			UpdatedAt:   delivery.UpdatedAt,
-		})
+		deliveries = append(deliveries, delivery)
 	}
 
 	c.IndentedJSON(http.StatusOK, deliveries)
@@ -95,20 +66,26 @@ func (h *Handlers) CreateDelivery(c *gin.Context) {
 		return
 	}
 
-	counterMutex.Lock()
-	defer counterMutex.Unlock()
-	deliveryCounter++
+	delivery_id, err := database.NextSequence(h.context, h.database, "Deliveries")
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Entregador não foi criado, ocorreu um erro inesperado",
+		})
+		return
+	}
 
 	delivery := Delivery{
-		ID:          deliveryCounter,
+		ID:          delivery_id,
 		Name:        body.Name,
 		PhoneNumber: body.PhoneNumber,
-		CreatedAt:   time.Now().String(),
-		UpdatedAt:   time.Now().String(),
+		CreatedAt:   time.Now(),
+		UpdatedAt:   time.Now(),
 	}
 
 	collection := h.database.Collection("Deliveries")
-	_, err := collection.InsertOne(h.context, delivery)
+	_, err = collection.InsertOne(h.context, delivery)
 	if err != nil {
 		log.Println(err.Error())
 		c.JSON(http.StatusInternalServerError, gin.H{
@@ -154,7 +131,7 @@ func (h *Handlers) UpdateDeliveryByID(c *gin.Context) {
 	update := bson.D{{Key: "$set", Value: bson.D{
 		{Key: "name", Value: body.Name},
 		{Key: "phone_number", Value: body.PhoneNumber},
-		{Key: "updated_at", Value: time.Now().String()},
+		{Key: "updated_at", Value: time.Now()},
 	}}}
 	opts := options.Update().SetUpsert(false)
 	_, err = collection.UpdateOne(h.context, filter, update, opts)
@@ -217,3 +194,38 @@ func (h *Handlers) DeleteDeliveryByID(c *gin.Context) {
 		"message":     "Entregador deletado com sucesso",
 	})
 }
+
+// findDeliveriesByID busca os entregadores de uma vez com $in. Ids que não
+// existem mais (entregador removido) recebem um entregador desconhecido no
+// lugar, para a listagem não falhar por causa deles.
+func (h *Handlers) findDeliveriesByID(ids []int) (map[int]Delivery, error) {
+	deliveries := make(map[int]Delivery, len(ids))
+	if len(ids) == 0 {
+		return deliveries, nil
+	}
+
+	collection := h.database.Collection("Deliveries")
+	cursor, err := collection.Find(h.context, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(h.context)
+
+	for cursor.Next(h.context) {
+		var delivery Delivery
+		if err := cursor.Decode(&delivery); err != nil {
+			return nil, err
+		}
+		deliveries[delivery.ID] = delivery
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		if _, exists := deliveries[id]; !exists {
+			deliveries[id] = Delivery{ID: id, Name: unknownDeliveryName}
+		}
+	}
+	return deliveries, nil
+}
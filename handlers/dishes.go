@@ -19,26 +19,30 @@ import (
 )
 
 type Dish struct {
-	ID          primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
-	Title       string             `bson:"title" json:"title"`
-	Price       float64            `bson:"price" json:"price"`
-	Description string             `bson:"description" json:"description,omitempty"`
-	Serves      int                `bson:"serves" json:"serves"`
-	DayOfWeek   string             `bson:"day_of_week" json:"day_of_week"`
-	ImgURL      string             `bson:"img_url" json:"img_url"`
-	Active      bool               `bson:"active" json:"active"`
-	CreatedAt   string             `bson:"created_at" json:"created_at"`
-	UpdatedAt   string             `bson:"updated_at" json:"updated_at"`
+	ID                     primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	Title                  string             `bson:"title" json:"title"`
+	Price                  Money              `bson:"price" json:"price"`
+	Description            string             `bson:"description" json:"description,omitempty"`
+	Serves                 int                `bson:"serves" json:"serves"`
+	DayOfWeek              string             `bson:"day_of_week" json:"day_of_week"`
+	ImgURL                 string             `bson:"img_url" json:"img_url"`
+	Active                 bool               `bson:"active" json:"active"`
+	MaxAccompanimentsCount int                `bson:"max_accompaniments_count" json:"max_accompaniments_count"`
+	Discount               Money              `bson:"discount" json:"discount"`
+	CreatedAt              time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt              time.Time          `bson:"updated_at" json:"updated_at"`
 }
 
 type TDishReqBody struct {
-	Title       string  `bson:"title" json:"title" validate:"required,max=50"`
-	Price       float64 `bson:"price" json:"price" validate:"required"`
-	Description string  `bson:"description" json:"description" validate:"max=200"`
-	Serves      int     `bson:"serves" json:"serves"`
-	DayOfWeek   string  `bson:"day_of_week" json:"day_of_week"`
-	ImgURL      string  `bson:"img_url" json:"img_url"`
-	Active      *bool   `bson:"active" json:"active"`
+	Title                  string `bson:"title" json:"title" validate:"required,max=50"`
+	Price                  Money  `bson:"price" json:"price" validate:"required,gt=0"`
+	Description            string `bson:"description" json:"description" validate:"max=200"`
+	Serves                 int    `bson:"serves" json:"serves"`
+	DayOfWeek              string `bson:"day_of_week" json:"day_of_week"`
+	ImgURL                 string `bson:"img_url" json:"img_url"`
+	Active                 *bool  `bson:"active" json:"active"`
+	MaxAccompanimentsCount *int   `bson:"max_accompaniments_count" json:"max_accompaniments_count" validate:"omitempty,min=0"`
+	Discount               *Money `bson:"discount" json:"discount" validate:"omitempty,min=0"`
 }
 
 func (h *Handlers) GetDishes(c *gin.Context) {
@@ -51,14 +55,6 @@ func (h *Handlers) GetDishes(c *gin.Context) {
 		return
 	}
 
-	parseCreatedAt := func(dateStr string) (time.Time, error) {
-		parts := strings.Split(dateStr, " ")
-		datePart := parts[0] // "2024-08-02"
-		timePart := parts[1] // "13:58:00.346461603"
-
-		return time.Parse("2006-01-02 15:04:05.999999999", fmt.Sprintf("%s %s", datePart, timePart))
-	}
-
 	dishes := make([]Dish, 0)
 	for cursor.Next(h.context) {
 		var dish Dish
@@ -71,28 +67,7 @@ func (h *Handlers) GetDishes(c *gin.Context) {
 			return
 		}
 
-		createdAt, err := parseCreatedAt(dish.CreatedAt)
-		if err != nil {
-			log.Println(err.Error())
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"status_code": http.StatusInternalServerError,
-				"message":     "Erro ao converter a data de criação",
-			})
-			return
-		}
-
-		dishes = append(dishes, Dish{
-			ID:          dish.ID,
-			Title:       dish.Title,
-			Price:       dish.Price,
-			Description: dish.Description,
-			Serves:      dish.Serves,
-			DayOfWeek:   dish.DayOfWeek,
-			ImgURL:      dish.ImgURL,
-			Active:      dish.Active,
-			CreatedAt:   createdAt.Format("2006-01-02 15:04:05"),
-			UpdatedAt:   dish.UpdatedAt,
-		})
+		dishes = append(dishes, dish)
 	}
 
 	c.IndentedJSON(http.StatusOK, dishes)
@@ -141,17 +116,29 @@ func (h *Handlers) CreateDish(c *gin.Context) {
 		return
 	}
 
+	max_accompaniments := 0
+	if body.MaxAccompanimentsCount != nil {
+		max_accompaniments = *body.MaxAccompanimentsCount
+	}
+
+	var discount Money
+	if body.Discount != nil {
+		discount = *body.Discount
+	}
+
 	dish := Dish{
-		ID:          primitive.NewObjectID(),
-		Title:       body.Title,
-		Price:       body.Price,
-		Description: body.Description,
-		Serves:      body.Serves,
-		DayOfWeek:   body.DayOfWeek,
-		ImgURL:      body.ImgURL,
-		Active:      *body.Active,
-		CreatedAt:   time.Now().String(),
-		UpdatedAt:   time.Now().String(),
+		ID:                     primitive.NewObjectID(),
+		Title:                  body.Title,
+		Price:                  body.Price,
+		Description:            body.Description,
+		Serves:                 body.Serves,
+		DayOfWeek:              body.DayOfWeek,
+		ImgURL:                 body.ImgURL,
+		Active:                 *body.Active,
+		MaxAccompanimentsCount: max_accompaniments,
+		Discount:               discount,
+		CreatedAt:              time.Now(),
+		UpdatedAt:              time.Now(),
 	}
 
 	collection := h.database.Collection("Dishes")
@@ -316,8 +303,14 @@ func (h *Handlers) UpdateDish(c *gin.Context) {
 	if body.Active != nil {
 		updateFields = append(updateFields, bson.E{Key: "active", Value: *body.Active})
 	}
+	if body.MaxAccompanimentsCount != nil {
+		updateFields = append(updateFields, bson.E{Key: "max_accompaniments_count", Value: *body.MaxAccompanimentsCount})
+	}
+	if body.Discount != nil {
+		updateFields = append(updateFields, bson.E{Key: "discount", Value: *body.Discount})
+	}
 
-	updateFields = append(updateFields, bson.E{Key: "updated_at", Value: time.Now().String()})
+	updateFields = append(updateFields, bson.E{Key: "updated_at", Value: time.Now()})
 
 	update := bson.D{{Key: "$set", Value: updateFields}}
 
@@ -359,6 +352,13 @@ func (h *Handlers) DeleteDish(c *gin.Context) {
 		return
 	}
 
+	// Tira o prato dos cardápios; se falhar, ele só deixa de aparecer na leitura
+	menus_filter := bson.D{{Key: "sections.dish_ids", Value: id}}
+	menus_update := bson.D{{Key: "$pull", Value: bson.D{{Key: "sections.$[].dish_ids", Value: id}}}}
+	if _, err := h.database.Collection("Menus").UpdateMany(h.context, menus_filter, menus_update); err != nil {
+		log.Println("Erro ao remover o prato dos cardápios:", err.Error())
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"status_code": http.StatusOK,
 		"message":     "Prato deletado com sucesso",
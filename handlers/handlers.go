@@ -9,11 +9,25 @@ import (
 type Handlers struct {
 	context  context.Context
 	database *mongo.Database
+	hasher   PasswordHasher
+	sender   MessageSender
+	payments PaymentProvider
 }
 
-func NewHandlers(context context.Context, database *mongo.Database) *Handlers {
+func NewHandlers(context context.Context, database *mongo.Database) (*Handlers, error) {
+	sender, err := newMessageSender()
+	if err != nil {
+		return nil, err
+	}
+	payments, err := newPaymentProvider()
+	if err != nil {
+		return nil, err
+	}
 	return &Handlers{
 		database: database,
 		context:  context,
-	}
+		hasher:   newPasswordHasher(),
+		sender:   sender,
+		payments: payments,
+	}, nil
 }
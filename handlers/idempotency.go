@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sergingroisman/meal-maker-functions/cmd/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	idempotencyHeader     = "Idempotency-Key"
+	idempotencyProcessing = "processing"
+	idempotencyCompleted  = "completed"
+)
+
+// IdempotencyKey guarda a resposta de uma requisição feita com o header
+// Idempotency-Key. A chave vale por usuário e expira por TTL.
+type IdempotencyKey struct {
+	ID             string             `bson:"_id"`
+	UserID         primitive.ObjectID `bson:"user_id"`
+	Key            string             `bson:"key"`
+	Route          string             `bson:"route"`
+	RequestHash    string             `bson:"request_hash"`
+	Status         string             `bson:"status"`
+	ResponseStatus int                `bson:"response_status,omitempty"`
+	ResponseBody   []byte             `bson:"response_body,omitempty"`
+	CreatedAt      time.Time          `bson:"created_at"`
+	ExpiresAt      time.Time          `bson:"expires_at"`
+}
+
+// idempotentRequest é a chave reservada por beginIdempotentRequest. Se a
+// requisição terminar sem respond, release apaga a reserva para o cliente
+// poder tentar de novo.
+type idempotentRequest struct {
+	h         *Handlers
+	id        string
+	completed bool
+}
+
+// beginIdempotentRequest reserva a chave do header para o usuário. Retorna
+// false quando a resposta já foi enviada: a original, se a chave já foi usada,
+// ou um erro. Sem o header, retorna nil e true.
+func (h *Handlers) beginIdempotentRequest(c *gin.Context, user_id primitive.ObjectID) (*idempotentRequest, bool) {
+	key := c.GetHeader(idempotencyHeader)
+	if key == "" {
+		return nil, true
+	}
+	if len(key) > 255 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Idempotency-Key inválida",
+		})
+		return nil, false
+	}
+
+	request_hash := ""
+	if body, exists := c.Get(gin.BodyBytesKey); exists {
+		sum := sha256.Sum256(body.([]byte))
+		request_hash = hex.EncodeToString(sum[:])
+	}
+
+	record := IdempotencyKey{
+		ID:          user_id.Hex() + ":" + key,
+		UserID:      user_id,
+		Key:         key,
+		Route:       c.FullPath(),
+		RequestHash: request_hash,
+		Status:      idempotencyProcessing,
+		CreatedAt:   time.Now(),
+		ExpiresAt:   time.Now().Add(config.Env.Idempotency.Window),
+	}
+
+	collection := h.database.Collection("IdempotencyKeys")
+	for attempt := 0; attempt < 2; attempt++ {
+		_, err := collection.InsertOne(h.context, record)
+		if err == nil {
+			return &idempotentRequest{h: h, id: record.ID}, true
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			log.Println(err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status_code": http.StatusInternalServerError,
+				"message":     "Não foi possível processar a requisição",
+			})
+			return nil, false
+		}
+
+		var existing IdempotencyKey
+		err = collection.FindOne(h.context, bson.D{{Key: "_id", Value: record.ID}}).Decode(&existing)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			continue
+		}
+		if err != nil {
+			log.Println(err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status_code": http.StatusInternalServerError,
+				"message":     "Não foi possível processar a requisição",
+			})
+			return nil, false
+		}
+
+		// O TTL do Mongo pode demorar até um minuto para apagar a chave vencida
+		if existing.ExpiresAt.Before(time.Now()) {
+			collection.DeleteOne(h.context, bson.D{{Key: "_id", Value: existing.ID}, {Key: "expires_at", Value: existing.ExpiresAt}})
+			continue
+		}
+
+		respondIdempotentReplay(c, existing, request_hash)
+		return nil, false
+	}
+
+	c.JSON(http.StatusConflict, gin.H{
+		"status_code": http.StatusConflict,
+		"message":     "Requisição com essa Idempotency-Key já está sendo processada",
+	})
+	return nil, false
+}
+
+func respondIdempotentReplay(c *gin.Context, existing IdempotencyKey, request_hash string) {
+	if existing.Route != c.FullPath() || existing.RequestHash != request_hash {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"status_code": http.StatusUnprocessableEntity,
+			"message":     "Essa Idempotency-Key já foi usada em outra requisição",
+		})
+		return
+	}
+	if existing.Status != idempotencyCompleted {
+		c.JSON(http.StatusConflict, gin.H{
+			"status_code": http.StatusConflict,
+			"message":     "Requisição com essa Idempotency-Key já está sendo processada",
+		})
+		return
+	}
+
+	c.Header("Idempotent-Replayed", "true")
+	c.Data(existing.ResponseStatus, "application/json; charset=utf-8", existing.ResponseBody)
+}
+
+// respond grava a resposta junto da chave e a envia. Sem chave, só envia.
+func (r *idempotentRequest) respond(c *gin.Context, status int, response gin.H) {
+	if r == nil {
+		c.JSON(status, response)
+		return
+	}
+
+	// Mesmo se a gravação falhar a reserva fica: a operação já foi feita e
+	// repetir a requisição não pode executá-la de novo
+	r.completed = true
+
+	body, err := json.Marshal(response)
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(status, response)
+		return
+	}
+
+	collection := r.h.database.Collection("IdempotencyKeys")
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "status", Value: idempotencyCompleted},
+		{Key: "response_status", Value: status},
+		{Key: "response_body", Value: body},
+	}}}
+	_, err = collection.UpdateOne(r.h.context, bson.D{{Key: "_id", Value: r.id}}, update)
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	c.Data(status, "application/json; charset=utf-8", body)
+}
+
+// release apaga a reserva de uma requisição que não terminou com sucesso.
+func (r *idempotentRequest) release() {
+	if r == nil || r.completed {
+		return
+	}
+	collection := r.h.database.Collection("IdempotencyKeys")
+	if _, err := collection.DeleteOne(r.h.context, bson.D{{Key: "_id", Value: r.id}}); err != nil {
+		log.Println(err.Error())
+	}
+}
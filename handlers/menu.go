@@ -1,40 +1,89 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"sort"
 	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type Accompaniment struct {
 	ID               primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
 	Title            string             `bson:"title" json:"title"`
 	SmallDescription string             `bson:"small_description" json:"small_description"`
-	CreatedAt        string             `bson:"created_at" json:"created_at"`
-	UpdatedAt        string             `bson:"updated_at" json:"updated_at"`
+	CreatedAt        time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt        time.Time          `bson:"updated_at" json:"updated_at"`
 }
 
+// Menu guarda só os ids dos pratos de cada seção; os pratos são buscados na
+// leitura, então edições no prato aparecem no cardápio. LegacyDishes são os
+// pratos copiados por cardápios criados antes das seções; só o _id é lido, já
+// que a cópia pode ter preços ainda em reais.
 type Menu struct {
 	ID               primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
 	Name             string             `bson:"name" json:"name"`
 	SmallDescription string             `bson:"small_description" json:"small_description"`
 	PartnerID        int                `bson:"partner_id" json:"partner_id"`
-	Dishes           []Dish             `bson:"dishes" json:"dishes"`
-	CreatedAt        string             `bson:"created_at" json:"created_at"`
-	UpdatedAt        string             `bson:"updated_at" json:"updated_at"`
+	Sections         []MenuSection      `bson:"sections" json:"sections"`
+	LegacyDishes     []legacyMenuDish   `bson:"dishes,omitempty" json:"-"`
+	CreatedAt        time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt        time.Time          `bson:"updated_at" json:"updated_at"`
 }
 
+type legacyMenuDish struct {
+	ID primitive.ObjectID `bson:"_id"`
+}
+
+type MenuSection struct {
+	Title    string               `bson:"title" json:"title"`
+	Position int                  `bson:"position" json:"position"`
+	DishIDs  []primitive.ObjectID `bson:"dish_ids" json:"dish_ids"`
+}
+
+type MenuResponse struct {
+	ID               primitive.ObjectID    `json:"_id"`
+	Name             string                `json:"name"`
+	SmallDescription string                `json:"small_description"`
+	PartnerID        int                   `json:"partner_id"`
+	Sections         []MenuSectionResponse `json:"sections"`
+	CreatedAt        time.Time             `json:"created_at"`
+	UpdatedAt        time.Time             `json:"updated_at"`
+}
+
+type MenuSectionResponse struct {
+	Title    string `json:"title"`
+	Position int    `json:"position"`
+	Dishes   []Dish `json:"dishes"`
+}
+
+type MenuSectionReqBody struct {
+	Title  string   `json:"title" validate:"required,max=40"`
+	Dishes []string `json:"dishes"`
+}
+
+// MenuCreateReqBody aceita as seções na ordem de exibição. Só dishes, sem
+// seções, é o formato antigo e vira uma seção única.
 type MenuCreateReqBody struct {
-	Name             string   `bson:"name" json:"name" validate:"required,max=40"`
-	SmallDescription string   `bson:"small_description" json:"small_description"`
-	PartnerID        int      `bson:"partner_id" json:"partner_id"`
-	Dishes           []string `bson:"dishes" json:"dishes"`
+	Name             string               `json:"name" validate:"required,max=40"`
+	SmallDescription string               `json:"small_description"`
+	Sections         []MenuSectionReqBody `json:"sections" validate:"dive"`
+	Dishes           []string             `json:"dishes"`
+}
+
+type MenuUpdateReqBody struct {
+	Name             string               `json:"name" validate:"max=40"`
+	SmallDescription *string              `json:"small_description"`
+	Sections         []MenuSectionReqBody `json:"sections" validate:"dive"`
 }
 
 type DishCreateReqBody struct {
@@ -58,6 +107,130 @@ type AccompanimentCreateReqBody struct {
 	Accompaniments []AccompanimentCreateOrUpdate `bson:"accompaniments" json:"accompaniments"`
 }
 
+// MenuError é um cardápio inválido enviado pelo parceiro; a mensagem vai na
+// resposta 400.
+type MenuError struct {
+	Message string
+}
+
+func (e *MenuError) Error() string {
+	return e.Message
+}
+
+// buildMenuSections converte as seções do corpo da requisição, na ordem
+// recebida, conferindo se todos os pratos existem.
+func (h *Handlers) buildMenuSections(body []MenuSectionReqBody) ([]MenuSection, error) {
+	sections := make([]MenuSection, 0, len(body))
+	dish_ids := make([]primitive.ObjectID, 0)
+	for position, section := range body {
+		ids := make([]primitive.ObjectID, 0, len(section.Dishes))
+		for _, id_str := range section.Dishes {
+			id, err := primitive.ObjectIDFromHex(id_str)
+			if err != nil {
+				return nil, &MenuError{Message: fmt.Sprintf("Prato %q não encontrado", id_str)}
+			}
+			ids = append(ids, id)
+		}
+		dish_ids = append(dish_ids, ids...)
+		sections = append(sections, MenuSection{Title: section.Title, Position: position, DishIDs: ids})
+	}
+
+	if len(dish_ids) > 0 {
+		dishes, err := h.findDishesByID(dish_ids)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range dish_ids {
+			if _, exists := dishes[id]; !exists {
+				return nil, &MenuError{Message: fmt.Sprintf("Prato %q não encontrado", id.Hex())}
+			}
+		}
+	}
+	return sections, nil
+}
+
+func respondMenuError(c *gin.Context, err error) {
+	var menu_err *MenuError
+	if errors.As(err, &menu_err) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     menu_err.Message,
+		})
+		return
+	}
+	log.Println(err.Error())
+	c.JSON(http.StatusInternalServerError, gin.H{
+		"status_code": http.StatusInternalServerError,
+		"message":     "Não foi possível carregar os pratos do cardápio",
+	})
+}
+
+// menuSections devolve as seções em ordem. Cardápios antigos, com os pratos
+// copiados, viram uma seção única com os ids desses pratos.
+func (menu *Menu) menuSections() []MenuSection {
+	if len(menu.Sections) == 0 && len(menu.LegacyDishes) > 0 {
+		ids := make([]primitive.ObjectID, 0, len(menu.LegacyDishes))
+		for _, dish := range menu.LegacyDishes {
+			ids = append(ids, dish.ID)
+		}
+		return []MenuSection{{Title: "Cardápio", DishIDs: ids}}
+	}
+	sections := append([]MenuSection{}, menu.Sections...)
+	sort.SliceStable(sections, func(i, j int) bool {
+		return sections[i].Position < sections[j].Position
+	})
+	return sections
+}
+
+// resolveMenus busca de uma vez os pratos atuais de todos os cardápios.
+// Pratos que foram removidos somem do cardápio.
+func (h *Handlers) resolveMenus(menus []Menu) ([]MenuResponse, error) {
+	dish_ids := make([]primitive.ObjectID, 0)
+	for i := range menus {
+		for _, section := range menus[i].menuSections() {
+			dish_ids = append(dish_ids, section.DishIDs...)
+		}
+	}
+
+	dishes := map[primitive.ObjectID]Dish{}
+	if len(dish_ids) > 0 {
+		var err error
+		dishes, err = h.findDishesByID(dish_ids)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	responses := make([]MenuResponse, 0, len(menus))
+	for i := range menus {
+		menu := &menus[i]
+		sections := make([]MenuSectionResponse, 0, len(menu.Sections))
+		for _, section := range menu.menuSections() {
+			section_dishes := make([]Dish, 0, len(section.DishIDs))
+			for _, id := range section.DishIDs {
+				if dish, exists := dishes[id]; exists {
+					section_dishes = append(section_dishes, dish)
+				}
+			}
+			sections = append(sections, MenuSectionResponse{
+				Title:    section.Title,
+				Position: section.Position,
+				Dishes:   section_dishes,
+			})
+		}
+		responses = append(responses, MenuResponse{
+			ID:               menu.ID,
+			Name:             menu.Name,
+			SmallDescription: menu.SmallDescription,
+			PartnerID:        menu.PartnerID,
+			Sections:         sections,
+			CreatedAt:        menu.CreatedAt,
+			UpdatedAt:        menu.UpdatedAt,
+		})
+	}
+	return responses, nil
+}
+
 func (h *Handlers) GetMenusByPartnerId(c *gin.Context) {
 	collection := h.database.Collection("Menus")
 
@@ -76,11 +249,14 @@ func (h *Handlers) GetMenusByPartnerId(c *gin.Context) {
 	}
 
 	filter := bson.D{{Key: "partner_id", Value: partner_id}}
-	cursor, err := collection.Find(h.context, filter)
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}})
+	cursor, err := collection.Find(h.context, filter, opts)
 	if err != nil {
 		c.IndentedJSON(http.StatusInternalServerError, err)
 		return
 	}
+	defer cursor.Close(h.context)
+
 	menus := make([]Menu, 0)
 	for cursor.Next(h.context) {
 		var menu Menu
@@ -88,14 +264,20 @@ func (h *Handlers) GetMenusByPartnerId(c *gin.Context) {
 			log.Println(err.Error())
 			c.JSON(http.StatusInternalServerError, gin.H{
 				"status_code": http.StatusInternalServerError,
-				"message":     "Não foi possível processar a lista de usuários",
+				"message":     "Não foi possível processar a lista de cardápios",
 			})
 			return
 		}
 		menus = append(menus, menu)
 	}
 
-	c.IndentedJSON(http.StatusOK, menus)
+	responses, err := h.resolveMenus(menus)
+	if err != nil {
+		respondMenuError(c, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, responses)
 }
 
 func (h *Handlers) GetMenuById(c *gin.Context) {
@@ -103,28 +285,49 @@ func (h *Handlers) GetMenuById(c *gin.Context) {
 
 	menu_id_str := c.Param("menu_id")
 	if menu_id_str == "" {
-		c.IndentedJSON(http.StatusBadRequest, "Necessário passar id do prato por parâmetro")
+		c.IndentedJSON(http.StatusBadRequest, "Necessário passar id do cardápio por parâmetro")
+		return
+	}
+	menu_id, err := primitive.ObjectIDFromHex(menu_id_str)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Formato de ID inválido",
+		})
 		return
 	}
 
 	var menu Menu
-	menu_id, _ := primitive.ObjectIDFromHex(menu_id_str)
 	filter := bson.D{{Key: "_id", Value: menu_id}}
-	err := collection.FindOne(h.context, filter).Decode(&menu)
-
+	err = collection.FindOne(h.context, filter).Decode(&menu)
 	if err != nil {
 		log.Println(err.Error())
 		c.JSON(http.StatusNotFound, gin.H{
 			"status_code": http.StatusNotFound,
-			"message":     "Não foi possível encontrar um prato com esse ID",
+			"message":     "Não foi possível encontrar um cardápio com esse ID",
 		})
 		return
 	}
 
-	c.IndentedJSON(http.StatusOK, menu)
+	responses, err := h.resolveMenus([]Menu{menu})
+	if err != nil {
+		respondMenuError(c, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, responses[0])
 }
 
 func (h *Handlers) CreateMenuByPartnerID(c *gin.Context) {
+	partner_id, err := strconv.Atoi(c.Param("partner_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Formato de id inválido",
+		})
+		return
+	}
+
 	body := MenuCreateReqBody{}
 	if err := c.ShouldBindBodyWithJSON(&body); err != nil {
 		log.Println(err.Error())
@@ -135,37 +338,23 @@ func (h *Handlers) CreateMenuByPartnerID(c *gin.Context) {
 		return
 	}
 
-	dishes := make([]Dish, 0)
-	if len(body.Dishes) > 0 {
-		collectionD := h.database.Collection("Dishes")
-
-		for _, dishID := range body.Dishes {
-			dish_id, _ := primitive.ObjectIDFromHex(dishID)
-			filter := bson.D{{Key: "_id", Value: dish_id}}
-			cursor, err := collectionD.Find(h.context, filter)
-			if err != nil {
-				c.IndentedJSON(http.StatusInternalServerError, err)
-				return
-			}
-
-			for cursor.Next(h.context) {
-				var dish Dish
-				if err := cursor.Decode(&dish); err != nil {
-					log.Println(err.Error())
-					c.JSON(http.StatusInternalServerError, gin.H{
-						"status_code": http.StatusInternalServerError,
-						"message":     "Não foi possível processar a lista de acompanhamentos",
-					})
-					return
-				}
-				dishes = append(dishes, dish)
-			}
-		}
+	validate := validator.New()
+	if err := validate.Struct(&body); err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Formulário não está válido",
+		})
+		return
 	}
 
-	partner_id := 1
-	if body.PartnerID != 0 {
-		partner_id = body.PartnerID
+	if len(body.Sections) == 0 && len(body.Dishes) > 0 {
+		body.Sections = []MenuSectionReqBody{{Title: "Cardápio", Dishes: body.Dishes}}
+	}
+	sections, err := h.buildMenuSections(body.Sections)
+	if err != nil {
+		respondMenuError(c, err)
+		return
 	}
 
 	menu := Menu{
@@ -173,25 +362,159 @@ func (h *Handlers) CreateMenuByPartnerID(c *gin.Context) {
 		Name:             body.Name,
 		SmallDescription: body.SmallDescription,
 		PartnerID:        partner_id,
-		Dishes:           dishes,
-		CreatedAt:        time.Now().String(),
-		UpdatedAt:        time.Now().String(),
+		Sections:         sections,
+		CreatedAt:        time.Now(),
+		UpdatedAt:        time.Now(),
 	}
 
 	collection := h.database.Collection("Menus")
-	_, err := collection.InsertOne(h.context, menu)
+	_, err = collection.InsertOne(h.context, menu)
 	if err != nil {
 		log.Println(err.Error())
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"status_code": http.StatusInternalServerError,
-			"message":     "Prato não foi cadastrado com sucesso",
+			"message":     "Cardápio não foi cadastrado com sucesso",
+		})
+		return
+	}
+
+	responses, err := h.resolveMenus([]Menu{menu})
+	if err != nil {
+		respondMenuError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status_code": http.StatusOK,
+		"menu":        responses[0],
+	})
+}
+
+// UpdateMenuByID altera nome e descrição e, quando sections é enviado,
+// substitui todas as seções na nova ordem.
+func (h *Handlers) UpdateMenuByID(c *gin.Context) {
+	partner_id, err := strconv.Atoi(c.Param("partner_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Formato de id inválido",
+		})
+		return
+	}
+	menu_id, err := primitive.ObjectIDFromHex(c.Param("menu_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Formato de ID inválido",
+		})
+		return
+	}
+
+	body := MenuUpdateReqBody{}
+	if err := c.ShouldBindBodyWithJSON(&body); err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Não foi possível processar esses dados para atualizar o cardápio",
+		})
+		return
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(&body); err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Formulário não está válido",
+		})
+		return
+	}
+
+	update_fields := bson.D{{Key: "updated_at", Value: time.Now()}}
+	if body.Name != "" {
+		update_fields = append(update_fields, bson.E{Key: "name", Value: body.Name})
+	}
+	if body.SmallDescription != nil {
+		update_fields = append(update_fields, bson.E{Key: "small_description", Value: *body.SmallDescription})
+	}
+	update := bson.D{}
+	if body.Sections != nil {
+		sections, err := h.buildMenuSections(body.Sections)
+		if err != nil {
+			respondMenuError(c, err)
+			return
+		}
+		update_fields = append(update_fields, bson.E{Key: "sections", Value: sections})
+		// As seções substituem a cópia antiga dos pratos
+		update = append(update, bson.E{Key: "$unset", Value: bson.D{{Key: "dishes", Value: ""}}})
+	}
+	update = append(bson.D{{Key: "$set", Value: update_fields}}, update...)
+
+	collection := h.database.Collection("Menus")
+	filter := bson.D{{Key: "_id", Value: menu_id}, {Key: "partner_id", Value: partner_id}}
+	result, err := collection.UpdateOne(h.context, filter, update)
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível atualizar o cardápio",
+		})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status_code": http.StatusNotFound,
+			"message":     "Cardápio não encontrado",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status_code": http.StatusOK,
+		"message":     "Cardápio atualizado com sucesso",
+	})
+}
+
+func (h *Handlers) DeleteMenuByID(c *gin.Context) {
+	partner_id, err := strconv.Atoi(c.Param("partner_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Formato de id inválido",
+		})
+		return
+	}
+	menu_id, err := primitive.ObjectIDFromHex(c.Param("menu_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Formato de ID inválido",
+		})
+		return
+	}
+
+	collection := h.database.Collection("Menus")
+	filter := bson.D{{Key: "_id", Value: menu_id}, {Key: "partner_id", Value: partner_id}}
+	result, err := collection.DeleteOne(h.context, filter)
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível deletar o cardápio",
+		})
+		return
+	}
+	if result.DeletedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status_code": http.StatusNotFound,
+			"message":     "Cardápio não encontrado",
 		})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"status_code": http.StatusOK,
-		"menu":        menu,
+		"message":     "Cardápio deletado com sucesso",
 	})
 }
 
@@ -237,8 +560,8 @@ func (h *Handlers) CreateAccompaniments(c *gin.Context) {
 			ID:               primitive.NewObjectID(),
 			Title:            acc.Title,
 			SmallDescription: acc.SmallDescription,
-			CreatedAt:        time.Now().String(),
-			UpdatedAt:        time.Now().String(),
+			CreatedAt:        time.Now(),
+			UpdatedAt:        time.Now(),
 		}
 		accompaniments = append(accompaniments, accompaniment)
 	}
@@ -278,7 +601,7 @@ func (h *Handlers) UpdateAccompaniments(c *gin.Context) {
 		update := bson.D{{Key: "$set", Value: bson.D{
 			{Key: "title", Value: acc.Title},
 			{Key: "small_description", Value: acc.SmallDescription},
-			{Key: "updated_at", Value: time.Now().String()},
+			{Key: "updated_at", Value: time.Now()},
 		}}}
 
 		wm = append(wm, mongo.NewUpdateOneModel().
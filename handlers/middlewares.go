@@ -1,14 +1,15 @@
 package handlers
 
 import (
+	"log"
 	"net/http"
 	"strings"
 
 	"github.com/gin-gonic/gin"
 )
 
-func AuthenticateMiddleware(c *gin.Context) {
-	authorization_header := c.Request.Header["Authorization"][0]
+func (h *Handlers) AuthenticateMiddleware(c *gin.Context) {
+	authorization_header := c.GetHeader("Authorization")
 	if authorization_header == "" {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status_code": http.StatusBadRequest,
@@ -18,8 +19,8 @@ func AuthenticateMiddleware(c *gin.Context) {
 		return
 	}
 
-	token_string := strings.Split(authorization_header, " ")[1]
-	if token_string == "" {
+	token_string := strings.TrimSpace(strings.TrimPrefix(authorization_header, "Bearer "))
+	if token_string == "" || token_string == authorization_header {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status_code": http.StatusBadRequest,
 			"message":     "Bearer Token Authorization missing in Header",
@@ -28,15 +29,36 @@ func AuthenticateMiddleware(c *gin.Context) {
 		return
 	}
 
-	_, err := verifyToken(token_string)
+	claims, err := verifyToken(token_string)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"status_code": http.StatusBadRequest,
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"status_code": http.StatusUnauthorized,
+			"message":     "Token inválido",
+		})
+		c.Abort()
+		return
+	}
+
+	if err := h.sessionIsActive(claims.SessionID); err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"status_code": http.StatusUnauthorized,
+			"message":     "Sessão expirada ou encerrada, faça o login novamente",
+		})
+		c.Abort()
+		return
+	}
+
+	auth_user, err := newAuthUser(claims)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"status_code": http.StatusUnauthorized,
 			"message":     "Token inválido",
 		})
 		c.Abort()
 		return
 	}
 
+	c.Set(authUserKey, auth_user)
 	c.Next()
 }
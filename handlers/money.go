@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Money é um valor em reais guardado em centavos. No banco é um inteiro; no
+// JSON continua sendo um número em reais com duas casas (23.99), para os apps
+// não precisarem mudar.
+type Money int64
+
+// MoneyFromFloat converte um valor em reais, arredondando para o centavo.
+func MoneyFromFloat(reais float64) Money {
+	return Money(math.Round(reais * 100))
+}
+
+// Reais devolve o valor como float64, apenas para exibição.
+func (m Money) Reais() float64 {
+	return float64(m) / 100
+}
+
+func (m Money) Add(other Money) Money {
+	return m + other
+}
+
+func (m Money) Sub(other Money) Money {
+	return m - other
+}
+
+// Mul multiplica pela quantidade de itens.
+func (m Money) Mul(quantity int) Money {
+	return m * Money(quantity)
+}
+
+// Percent calcula a porcentagem (0-100) do valor, arredondando para o centavo.
+func (m Money) Percent(percentage float64) Money {
+	return Money(math.Round(float64(m) * percentage / 100))
+}
+
+func (m Money) Min(other Money) Money {
+	if other < m {
+		return other
+	}
+	return m
+}
+
+// String formata no padrão brasileiro, ex: R$ 1.234,56.
+func (m Money) String() string {
+	sign := ""
+	cents := int64(m)
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	reais := strconv.FormatInt(cents/100, 10)
+	for i := len(reais) - 3; i > 0; i -= 3 {
+		reais = reais[:i] + "." + reais[i:]
+	}
+	return fmt.Sprintf("%sR$ %s,%02d", sign, reais, cents%100)
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	sign := ""
+	cents := int64(m)
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	return []byte(fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)), nil
+}
+
+// UnmarshalJSON aceita um número em reais (23.99) ou o mesmo número como
+// texto ("23.99"). Valores com mais de duas casas são arredondados.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+	text := strings.Trim(string(data), `"`)
+	reais, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return fmt.Errorf("valor monetário inválido %s", data)
+	}
+	*m = MoneyFromFloat(reais)
+	return nil
+}
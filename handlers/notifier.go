@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sergingroisman/meal-maker-functions/cmd/config"
+)
+
+const (
+	ChannelSMS      = "sms"
+	ChannelWhatsApp = "whatsapp"
+)
+
+type Message struct {
+	PhoneNumber string
+	Channel     string
+	Body        string
+}
+
+// MessageSender entrega mensagens para o telefone do cliente (SMS ou WhatsApp).
+// Novos provedores só precisam implementar essa interface e ser registrados
+// em newMessageSender.
+type MessageSender interface {
+	Send(ctx context.Context, message Message) error
+}
+
+// newMessageSender devolve nil quando não há provedor configurado; nesse caso
+// as rotas que enviam códigos respondem 503 (ver senderAvailable).
+func newMessageSender() (MessageSender, error) {
+	switch config.Env.Notifier.Provider {
+	case "":
+		return nil, nil
+	case "log":
+		if !config.IsDevelopment() {
+			log.Println("NOTIFIER_PROVIDER=log só vale em desenvolvimento, envio de mensagens desativado")
+			return nil, nil
+		}
+		return &logSender{}, nil
+	default:
+		return nil, fmt.Errorf("provedor de mensagens desconhecido %q", config.Env.Notifier.Provider)
+	}
+}
+
+// senderAvailable responde 503 quando não há como entregar mensagens, em vez
+// de confirmar o envio de um código que nunca chega.
+func (h *Handlers) senderAvailable(c *gin.Context) bool {
+	if h.sender != nil {
+		return true
+	}
+	c.JSON(http.StatusServiceUnavailable, gin.H{
+		"status_code": http.StatusServiceUnavailable,
+		"message":     "O envio de mensagens está indisponível no momento",
+	})
+	return false
+}
+
+// logSender apenas escreve a mensagem no log. Usado em desenvolvimento e testes.
+type logSender struct{}
+
+func (s *logSender) Send(ctx context.Context, message Message) error {
+	log.Printf("[%s] para %s: %s", message.Channel, message.PhoneNumber, message.Body)
+	return nil
+}
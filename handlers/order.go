@@ -1,18 +1,15 @@
 package handlers
 
 import (
-	"fmt"
+	"errors"
 	"log"
 	"net/http"
 	"strconv"
-	"strings"
-	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/sergingroisman/meal-maker-functions/database"
 	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type OrderStatus int
@@ -22,74 +19,114 @@ const (
 	OrderConfirmed                         // 1
 	OrderOutForDelivery                    // 2
 	OrderDelivered                         // 3
+	OrderCancelled                         // 4
+	OrderRejected                          // 5
 )
 
+var orderStatusDescriptions = map[OrderStatus]string{
+	OrderSent:           "Pedido Enviado",
+	OrderConfirmed:      "Pedido Confirmado",
+	OrderOutForDelivery: "Pedido Saiu para Entrega",
+	OrderDelivered:      "Pedido Entregue",
+	OrderCancelled:      "Pedido Cancelado",
+	OrderRejected:       "Pedido Recusado",
+}
+
 func (os OrderStatus) String() string {
-	return [...]string{
-		"Pedido Enviado",
-		"Pedido Confirmado",
-		"Pedido Saiu para Entrega",
-		"Pedido Entregue",
-	}[os]
+	if description, exists := orderStatusDescriptions[os]; exists {
+		return description
+	}
+	return "Status Desconhecido"
+}
+
+func (os OrderStatus) IsValid() bool {
+	_, exists := orderStatusDescriptions[os]
+	return exists
 }
 
 type OrderDishes struct {
 	ID             string          `json:"_id"`
 	Title          string          `json:"title"`
-	Price          float64         `json:"price"`
+	Price          Money           `json:"price"`
+	LineTotal      Money           `json:"line_total"`
 	Observation    string          `json:"observation"`
 	Quantity       int             `json:"quantity"`
 	Accompaniments []Accompaniment `json:"accompaniments"`
 }
 
 type Order struct {
-	ID            int           `bson:"_id,omitempty" json:"_id,omitempty"`
-	User          User          `bson:"user" json:"user"`
-	PartnerID     int           `bson:"partner_id" json:"partner_id"`
-	Dishes        []OrderDishes `bson:"dishes" json:"dishes"`
-	Status        OrderStatus   `bson:"status" json:"status"`
-	PaymentType   string        `bson:"payment_type" json:"payment_type"`
-	DeliveryID    int           `bson:"delivery_id" json:"delivery_id"`
-	DeliveryType  string        `bson:"delivery_type" json:"delivery_type"`
-	QuantityTotal int           `bson:"quantity_total" json:"quantity_total"`
-	Total         float64       `bson:"total" json:"total"`
-	CreatedAt     string        `bson:"created_at" json:"created_at"`
-	UpdatedAt     string        `bson:"updated_at" json:"updated_at"`
+	ID              int                `bson:"_id,omitempty" json:"_id,omitempty"`
+	User            User               `bson:"user" json:"user"`
+	PartnerID       int                `bson:"partner_id" json:"partner_id"`
+	Dishes          []OrderDishes      `bson:"dishes" json:"dishes"`
+	Status          OrderStatus        `bson:"status" json:"status"`
+	PaymentType     string             `bson:"payment_type" json:"payment_type"`
+	ChangeFor       Money              `bson:"change_for,omitempty" json:"change_for,omitempty"`
+	Change          Money              `bson:"change,omitempty" json:"change,omitempty"`
+	DeliveryID      int                `bson:"delivery_id" json:"delivery_id"`
+	DeliveryType    string             `bson:"delivery_type" json:"delivery_type"`
+	DeliveryAddress *UserAddress       `bson:"delivery_address,omitempty" json:"delivery_address,omitempty"`
+	QuantityTotal   int                `bson:"quantity_total" json:"quantity_total"`
+	Subtotal        Money              `bson:"subtotal" json:"subtotal"`
+	Discounts       []OrderDiscount    `bson:"discounts,omitempty" json:"discounts,omitempty"`
+	Discount        Money              `bson:"discount" json:"discount"`
+	CouponCode      string             `bson:"coupon_code,omitempty" json:"coupon_code,omitempty"`
+	Payment         *OrderPayment      `bson:"payment,omitempty" json:"payment,omitempty"`
+	DeliveryFee     Money              `bson:"delivery_fee" json:"delivery_fee"`
+	Total           Money              `bson:"total" json:"total"`
+	StatusHistory   []StatusChange     `bson:"status_history" json:"status_history"`
+	Cancellation    *OrderCancellation `bson:"cancellation,omitempty" json:"cancellation,omitempty"`
+	ScheduledFor    *time.Time         `bson:"scheduled_for,omitempty" json:"scheduled_for,omitempty"`
+	ScheduleSlotID  string             `bson:"schedule_slot_id,omitempty" json:"-"`
+	VisibleAt       time.Time          `bson:"visible_at" json:"visible_at"`
+	CreatedAt       time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt       time.Time          `bson:"updated_at" json:"updated_at"`
 }
 
 type OrderCreateReqBody struct {
 	PartnerID     int           `bson:"partner_id" json:"partner_id"`
 	UserID        string        `bson:"user_id" json:"user_id"`
 	QuantityTotal int           `bson:"quantity_total" json:"quantity_total"`
-	Total         float64       `bson:"total" json:"total"`
+	Total         Money         `bson:"total" json:"total"`
 	Dishes        []OrderDishes `bson:"dishes" json:"dishes"`
 	PaymentType   string        `bson:"payment_type" json:"payment_type"`
+	ChangeFor     *Money        `bson:"change_for" json:"change_for"`
 	DeliveryType  string        `bson:"delivery_type" json:"delivery_type"`
+	AddressID     string        `bson:"address_id" json:"address_id"`
+	ScheduledFor  *time.Time    `bson:"scheduled_for" json:"scheduled_for"`
+	CouponCode    string        `bson:"coupon_code" json:"coupon_code"`
 }
 
 type OrderUpdateReqBody struct {
-	Status OrderStatus `bson:"status" json:"status"`
+	Status *OrderStatus `bson:"status" json:"status"`
 }
 
 type OrderResponse struct {
-	ID            int           `json:"_id,omitempty"`
-	User          User          `json:"user"`
-	PartnerID     int           `json:"partner_id"`
-	Dishes        []OrderDishes `json:"dishes"`
-	Status        string        `json:"status"`
-	PaymentType   string        `json:"payment_type"`
-	Delivery      Delivery      `json:"delivery"`
-	DeliveryType  string        `json:"delivery_type"`
-	QuantityTotal int           `json:"quantity_total"`
-	Total         float64       `json:"total"`
-	CreatedAt     string        `bson:"created_at" json:"created_at"`
+	ID              int                `json:"_id,omitempty"`
+	User            User               `json:"user"`
+	PartnerID       int                `json:"partner_id"`
+	Dishes          []OrderDishes      `json:"dishes"`
+	Status          string             `json:"status"`
+	PaymentType     string             `json:"payment_type"`
+	ChangeFor       Money              `json:"change_for,omitempty"`
+	Change          Money              `json:"change,omitempty"`
+	Delivery        Delivery           `json:"delivery"`
+	DeliveryType    string             `json:"delivery_type"`
+	DeliveryAddress *UserAddress       `json:"delivery_address,omitempty"`
+	QuantityTotal   int                `json:"quantity_total"`
+	Subtotal        Money              `json:"subtotal"`
+	Discounts       []OrderDiscount    `json:"discounts,omitempty"`
+	Discount        Money              `json:"discount"`
+	CouponCode      string             `json:"coupon_code,omitempty"`
+	Payment         *OrderPayment      `json:"payment,omitempty"`
+	DeliveryFee     Money              `json:"delivery_fee"`
+	Total           Money              `json:"total"`
+	StatusHistory   []StatusChange     `json:"status_history"`
+	Cancellation    *OrderCancellation `json:"cancellation,omitempty"`
+	ScheduledFor    *time.Time         `json:"scheduled_for,omitempty"`
+	CreatedAt       time.Time          `bson:"created_at" json:"created_at"`
 }
 
-var (
-	orderCounter  int
-	counterOMutex sync.Mutex
-)
-
 func (h *Handlers) GetOrdersByPartnerID(c *gin.Context) {
 	collection := h.database.Collection("Orders")
 
@@ -107,39 +144,53 @@ func (h *Handlers) GetOrdersByPartnerID(c *gin.Context) {
 		return
 	}
 
-	parseCreatedAt := func(dateStr string) (time.Time, error) {
-		parts := strings.Split(dateStr, " ")
-		datePart := parts[0] // "2024-08-02"
-		timePart := parts[1] // "13:58:00.346461603"
-
-		return time.Parse("2006-01-02 15:04:05.999999999", fmt.Sprintf("%s %s", datePart, timePart))
+	partner, err := h.findPartnerForDay(partner_id)
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível carregar o parceiro",
+		})
+		return
 	}
 
-	// Calcular o início e fim do dia atual no formato correto
-	startOfDay := time.Now().Truncate(24 * time.Hour)
-	endOfDay := startOfDay.Add(24 * time.Hour)
-
-	startOfDayStr := startOfDay.Format("2006-01-02 15:04:05.999999999 -0300 -03")
-	endOfDayStr := endOfDay.Format("2006-01-02 15:04:05.999999999 -0300 -03")
+	query, err := parseOrderListQuery(c, partner.Location())
+	if err != nil {
+		respondOrderQueryError(c, err)
+		return
+	}
 
-	filter := bson.D{
-		{Key: "partner_id", Value: partner_id},
-		{Key: "created_at", Value: bson.D{{Key: "$gte", Value: startOfDayStr}, {Key: "$lt", Value: endOfDayStr}}},
+	now := time.Now()
+	filter := bson.D{{Key: "partner_id", Value: partner_id}}
+	// Sem from/to a listagem continua sendo a do dia, no fuso do parceiro,
+	// incluindo os pedidos feitos antes mas agendados para hoje
+	if !query.HasDateRange() {
+		start_of_day, end_of_day := partner.DayRange(now)
+		today := bson.D{{Key: "$gte", Value: start_of_day}, {Key: "$lt", Value: end_of_day}}
+		filter = append(filter, bson.E{Key: "$or", Value: bson.A{
+			bson.D{{Key: "created_at", Value: today}},
+			bson.D{{Key: "scheduled_for", Value: today}},
+		}})
 	}
+	filter = append(filter, query.Filter...)
 
+	// O feed da cozinha só mostra pedidos em andamento e esconde os agendados
+	// até perto do horário
 	if _, exists := c.GetQuery("feed"); exists {
-		filter = append(filter, bson.E{Key: "status", Value: bson.D{{Key: "$ne", Value: OrderDelivered}}})
+		finished := bson.D{{Key: "status", Value: bson.D{{Key: "$in", Value: []OrderStatus{OrderDelivered, OrderCancelled, OrderRejected}}}}}
+		not_visible := bson.D{{Key: "visible_at", Value: bson.D{{Key: "$gt", Value: now}}}}
+		filter = append(filter, bson.E{Key: "$nor", Value: bson.A{finished, not_visible}})
 	}
 
-	options := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
-	cursor, err := collection.Find(h.context, filter, options)
+	cursor, err := collection.Find(h.context, filter, query.FindOptions())
 	if err != nil {
 		c.IndentedJSON(http.StatusInternalServerError, err)
 		return
 	}
 	defer cursor.Close(h.context)
 
-	orders := make([]OrderResponse, 0)
+	orders := make([]Order, 0)
+	delivery_ids := make([]int, 0)
 	for cursor.Next(h.context) {
 		var order Order
 		if err := cursor.Decode(&order); err != nil {
@@ -150,92 +201,62 @@ func (h *Handlers) GetOrdersByPartnerID(c *gin.Context) {
 			})
 			return
 		}
-
-		createdAt, err := parseCreatedAt(order.CreatedAt)
-		if err != nil {
-			log.Println(err.Error())
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"status_code": http.StatusInternalServerError,
-				"message":     "Erro ao converter a data de criação",
-			})
-			return
+		orders = append(orders, order)
+		if order.DeliveryID != 0 {
+			delivery_ids = append(delivery_ids, order.DeliveryID)
 		}
+	}
 
+	// Uma única consulta para os entregadores de todos os pedidos da página
+	deliveries, err := h.findDeliveriesByID(delivery_ids)
+	if err != nil {
+		log.Println("Erro ao buscar entregadores:", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível carregar os entregadores dos pedidos",
+		})
+		return
+	}
+
+	responses := make([]OrderResponse, 0, len(orders))
+	for _, order := range orders {
 		var delivery Delivery
 		if order.DeliveryID != 0 {
-			collectionD := h.database.Collection("Deliveries")
-			filter := bson.D{{Key: "_id", Value: order.DeliveryID}}
-
-			// Realiza a consulta no banco de dados
-			err := collectionD.FindOne(h.context, filter).Decode(&delivery)
-
-			if err != nil {
-				// Loga o erro e retorna uma resposta JSON apropriada
-				log.Println("Erro ao buscar entrega:", err.Error())
-				c.JSON(http.StatusNotFound, gin.H{
-					"status_code": http.StatusNotFound,
-					"message":     "Não foi possível encontrar a entrega com o ID fornecido.",
-				})
-				return
-			}
+			delivery = deliveries[order.DeliveryID]
 		}
-
-		orders = append(orders, OrderResponse{
-			ID:            order.ID,
-			User:          order.User,
-			PartnerID:     order.PartnerID,
-			Dishes:        order.Dishes,
-			Status:        order.Status.String(),
-			PaymentType:   order.PaymentType,
-			Delivery:      delivery,
-			DeliveryType:  order.DeliveryType,
-			QuantityTotal: order.QuantityTotal,
-			Total:         order.Total,
-			CreatedAt:     createdAt.Format("2006-01-02 15:04:05"),
-		})
+		responses = append(responses, newOrderResponse(order, delivery))
 	}
 
-	c.IndentedJSON(http.StatusOK, orders)
+	c.IndentedJSON(http.StatusOK, query.Page(orders, responses))
 }
 
 func (h *Handlers) GetOrdersByUserID(c *gin.Context) {
 	collection := h.database.Collection("Orders")
 
-	user_id_str := c.Param("user_id")
-	if user_id_str == "" {
-		c.IndentedJSON(http.StatusBadRequest, "Necessário passar id do cardápio por parâmetro")
+	user_id, ok := resolveUserID(c)
+	if !ok {
 		return
 	}
-	user_id, err := primitive.ObjectIDFromHex(user_id_str)
+
+	query, err := parseOrderListQuery(c, defaultLocation())
 	if err != nil {
-		log.Println(err.Error())
-		c.JSON(http.StatusBadRequest, gin.H{
-			"status_code": http.StatusBadRequest,
-			"message":     "Formato de ID inválido",
-		})
+		respondOrderQueryError(c, err)
 		return
 	}
 
-	parseCreatedAt := func(dateStr string) (time.Time, error) {
-		parts := strings.Split(dateStr, " ")
-		datePart := parts[0] // "2024-08-02"
-		timePart := parts[1] // "13:58:00.346461603"
-
-		return time.Parse("2006-01-02 15:04:05.999999999", fmt.Sprintf("%s %s", datePart, timePart))
-	}
-
 	filter := bson.D{
 		{Key: "user._id", Value: user_id},
 	}
-	options := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
-	cursor, err := collection.Find(h.context, filter, options)
+	filter = append(filter, query.Filter...)
+	cursor, err := collection.Find(h.context, filter, query.FindOptions())
 	if err != nil {
 		c.IndentedJSON(http.StatusInternalServerError, err)
 		return
 	}
 	defer cursor.Close(h.context)
 
-	orders := make([]OrderResponse, 0)
+	orders := make([]Order, 0)
+	responses := make([]OrderResponse, 0)
 	for cursor.Next(h.context) {
 		var order Order
 		if err := cursor.Decode(&order); err != nil {
@@ -247,46 +268,59 @@ func (h *Handlers) GetOrdersByUserID(c *gin.Context) {
 			return
 		}
 
-		createdAt, err := parseCreatedAt(order.CreatedAt)
-		if err != nil {
-			log.Println(err.Error())
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"status_code": http.StatusInternalServerError,
-				"message":     "Erro ao converter a data de criação",
-			})
-			return
-		}
+		orders = append(orders, order)
+		responses = append(responses, newOrderResponse(order, Delivery{}))
+	}
 
-		orders = append(orders, OrderResponse{
-			ID:            order.ID,
-			User:          order.User,
-			PartnerID:     order.PartnerID,
-			Dishes:        order.Dishes,
-			Status:        order.Status.String(),
-			PaymentType:   order.PaymentType,
-			DeliveryType:  order.DeliveryType,
-			QuantityTotal: order.QuantityTotal,
-			Total:         order.Total,
-			CreatedAt:     createdAt.Format("2006-01-02 15:04:05"),
-		})
+	c.IndentedJSON(http.StatusOK, query.Page(orders, responses))
+}
+
+func newOrderResponse(order Order, delivery Delivery) OrderResponse {
+	return OrderResponse{
+		ID:              order.ID,
+		User:            order.User,
+		PartnerID:       order.PartnerID,
+		Dishes:          order.Dishes,
+		Status:          order.Status.String(),
+		PaymentType:     order.PaymentType,
+		ChangeFor:       order.ChangeFor,
+		Change:          order.Change,
+		Delivery:        delivery,
+		DeliveryType:    order.DeliveryType,
+		DeliveryAddress: order.DeliveryAddress,
+		QuantityTotal:   order.QuantityTotal,
+		Subtotal:        order.Subtotal,
+		Discounts:       order.Discounts,
+		Discount:        order.Discount,
+		CouponCode:      order.CouponCode,
+		Payment:         order.Payment,
+		DeliveryFee:     order.DeliveryFee,
+		Total:           order.Total,
+		StatusHistory:   order.StatusHistory,
+		Cancellation:    order.Cancellation,
+		ScheduledFor:    order.ScheduledFor,
+		CreatedAt:       order.CreatedAt,
 	}
+}
 
-	c.IndentedJSON(http.StatusOK, orders)
+func respondOrderQueryError(c *gin.Context, err error) {
+	message := "Filtros de pedidos inválidos"
+	var query_err *OrderQueryError
+	if errors.As(err, &query_err) {
+		message = query_err.Message
+	}
+	c.JSON(http.StatusBadRequest, gin.H{
+		"status_code": http.StatusBadRequest,
+		"message":     message,
+	})
 }
 
 func (h *Handlers) CreateOrderByUser(c *gin.Context) {
-	user_id_str := c.Param("user_id")
-	if user_id_str == "" {
-		c.IndentedJSON(http.StatusBadRequest, "Necessário passar o id do usuário por parâmetro")
+	user_id, ok := resolveUserID(c)
+	if !ok {
 		return
 	}
 
-	counterOMutex.Lock()
-	defer counterOMutex.Unlock()
-	orderCounter++
-
-	user_id, _ := primitive.ObjectIDFromHex(user_id_str)
-
 	body := OrderCreateReqBody{}
 	if err := c.ShouldBindBodyWithJSON(&body); err != nil {
 		log.Println(err.Error())
@@ -297,6 +331,12 @@ func (h *Handlers) CreateOrderByUser(c *gin.Context) {
 		return
 	}
 
+	idempotent, ok := h.beginIdempotentRequest(c, user_id)
+	if !ok {
+		return
+	}
+	defer idempotent.release()
+
 	partner_id := 1
 	if body.PartnerID != 0 {
 		partner_id = body.PartnerID
@@ -316,26 +356,151 @@ func (h *Handlers) CreateOrderByUser(c *gin.Context) {
 		return
 	}
 
+	delivery_address, err := h.resolveOrderAddress(user.ID, body.AddressID)
+	if errors.Is(err, errAddressNotFound) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Endereço de entrega não encontrado",
+		})
+		return
+	}
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível carregar o endereço de entrega",
+		})
+		return
+	}
+
+	// O pedido guarda uma cópia do endereço escolhido, não o caderno inteiro,
+	// e nunca o hash da senha
+	user.Addresses = nil
+	user.Password = ""
+
+	// Preços e totais são sempre recalculados a partir do cadastro; o total do
+	// app só serve para detectar um carrinho desatualizado ou adulterado
+	pricing, err := h.priceOrder(partner_id, body.DeliveryType, body.Dishes)
+	var pricing_err *OrderPricingError
+	if errors.As(err, &pricing_err) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     pricing_err.Message,
+		})
+		return
+	}
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível calcular o valor do pedido",
+		})
+		return
+	}
+
+	now := time.Now()
+	var coupon *Coupon
+	if body.CouponCode != "" {
+		coupon, err = h.applyCoupon(partner_id, user.ID, body.CouponCode, pricing, now)
+		if err != nil {
+			respondCouponError(c, err)
+			return
+		}
+	}
+
+	if body.Total != pricing.Total {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "O valor do pedido não confere com os preços atuais, atualize o carrinho e tente novamente",
+			"total":       pricing.Total,
+		})
+		return
+	}
+
+	change, err := checkOrderPayment(pricing.Partner, body.PaymentType, h.pixEnabled(), body.ChangeFor, pricing.Total)
+	var payment_err *PaymentMethodError
+	if errors.As(err, &payment_err) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     payment_err.Message,
+		})
+		return
+	}
+	var change_for Money
+	if change > 0 {
+		change_for = *body.ChangeFor
+	}
+
+	schedule_slot_id := ""
+	if body.ScheduledFor != nil {
+		schedule_slot_id, ok = h.scheduleOrder(c, pricing.Partner, *body.ScheduledFor, now)
+		if !ok {
+			return
+		}
+	}
+
+	coupon_code := ""
+	if coupon != nil {
+		if err := h.redeemCoupon(coupon, user.ID); err != nil {
+			h.releaseOrderSlot(schedule_slot_id)
+			respondCouponError(c, err)
+			return
+		}
+		coupon_code = coupon.Code
+	}
+	// Devolve a vaga e o uso do cupom se o pedido não chegar a ser gravado
+	release := func() {
+		h.releaseOrderSlot(schedule_slot_id)
+		if coupon != nil {
+			h.releaseCouponRedemption(coupon.ID, user.ID)
+		}
+	}
+
+	order_id, err := database.NextSequence(h.context, h.database, "Orders")
+	if err != nil {
+		log.Println(err.Error())
+		release()
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Pedido não foi efetuado com sucesso",
+		})
+		return
+	}
+
 	var status OrderStatus = OrderSent
 
 	order := Order{
-		ID:            orderCounter,
-		User:          user,
-		Status:        status,
-		PartnerID:     partner_id,
-		Dishes:        body.Dishes,
-		PaymentType:   body.PaymentType,
-		DeliveryType:  body.DeliveryType,
-		Total:         body.Total,
-		QuantityTotal: body.QuantityTotal,
-		CreatedAt:     time.Now().String(),
-		UpdatedAt:     time.Now().String(),
+		ID:              order_id,
+		User:            user,
+		Status:          status,
+		StatusHistory:   []StatusChange{newStatusChange(status, ActorCustomer, user.ID.Hex())},
+		PartnerID:       partner_id,
+		Dishes:          pricing.Dishes,
+		PaymentType:     body.PaymentType,
+		ChangeFor:       change_for,
+		Change:          change,
+		DeliveryType:    body.DeliveryType,
+		DeliveryAddress: delivery_address,
+		Subtotal:        pricing.Subtotal,
+		Discounts:       pricing.Discounts,
+		Discount:        pricing.Discount,
+		CouponCode:      coupon_code,
+		Payment:         newOrderPayment(body.PaymentType, pricing.Total, now),
+		DeliveryFee:     pricing.DeliveryFee,
+		Total:           pricing.Total,
+		QuantityTotal:   pricing.QuantityTotal,
+		ScheduledFor:    body.ScheduledFor,
+		ScheduleSlotID:  schedule_slot_id,
+		VisibleAt:       orderVisibleAt(body.ScheduledFor, now),
+		CreatedAt:       now,
+		UpdatedAt:       now,
 	}
 
 	collectionO := h.database.Collection("Orders")
 	_, err = collectionO.InsertOne(h.context, order)
 	if err != nil {
 		log.Println(err.Error())
+		release()
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"status_code": http.StatusInternalServerError,
 			"message":     "Pedido não foi efetuado com sucesso",
@@ -343,9 +508,12 @@ func (h *Handlers) CreateOrderByUser(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"status_code": http.StatusOK,
-		"order":       order,
+	tracking_token := trackingToken(order.ID)
+	idempotent.respond(c, http.StatusOK, gin.H{
+		"status_code":    http.StatusOK,
+		"order":          order,
+		"tracking_token": tracking_token,
+		"tracking_url":   trackingURL(tracking_token),
 	})
 }
 
@@ -375,18 +543,16 @@ func (h *Handlers) UpdateOrderByUser(c *gin.Context) {
 		return
 	}
 
-	var status OrderStatus = body.Status
-
-	collection := h.database.Collection("Orders")
-	filter := bson.D{{Key: "_id", Value: order_id}}
-	update := bson.D{{Key: "$set", Value: bson.D{
-		{Key: "status", Value: status},
-		{Key: "updated_at", Value: time.Now().String()},
-	}}}
+	auth_user := getAuthUser(c)
+	actor := orderActor(auth_user)
 
+	update_fields := bson.D{}
 	delivery_id_str, deliveryExists := c.GetQuery("delivery_id")
-
 	if deliveryExists {
+		if actor != ActorPartner && actor != ActorAdmin {
+			respondForbidden(c)
+			return
+		}
 		delivery_id, err := strconv.Atoi(delivery_id_str)
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{
@@ -395,25 +561,72 @@ func (h *Handlers) UpdateOrderByUser(c *gin.Context) {
 			})
 			return
 		}
-		update = append(update, bson.E{
-			Key: "$set", Value: bson.D{
-				{Key: "delivery_id", Value: delivery_id},
-			},
+		update_fields = append(update_fields, bson.E{Key: "delivery_id", Value: delivery_id})
+	}
+
+	if body.Status != nil && !body.Status.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Status de pedido inválido",
 		})
+		return
 	}
-	opts := options.Update().SetUpsert(false)
-	_, err = collection.UpdateOne(h.context, filter, update, opts)
-	if err != nil {
-		log.Println(err.Error())
+
+	order, ok := h.findScopedOrder(c, order_id)
+	if !ok {
+		return
+	}
+
+	// Só atribuir o entregador, sem mudar o status
+	if body.Status == nil || *body.Status == order.Status {
+		if len(update_fields) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status_code": http.StatusBadRequest,
+				"message":     "Nenhuma alteração informada para o pedido",
+			})
+			return
+		}
+		update_fields = append(update_fields, bson.E{Key: "updated_at", Value: time.Now()})
+		collection := h.database.Collection("Orders")
+		_, err := collection.UpdateOne(h.context, bson.D{{Key: "_id", Value: order.ID}}, bson.D{{Key: "$set", Value: update_fields}})
+		if err != nil {
+			log.Println(err.Error())
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status_code": http.StatusBadRequest,
+				"message":     "Não foi possível atualizar o pedido",
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"status_code": http.StatusOK,
+			"message":     "Pedido atualizado com sucesso",
+		})
+		return
+	}
+
+	status := *body.Status
+	if status == OrderCancelled {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status_code": http.StatusBadRequest,
-			"message":     "Não foi possível atualizar o status do pedido",
+			"message":     "Para cancelar o pedido use o cancelamento informando o motivo",
 		})
 		return
 	}
+	if err := checkOrderTransition(order.Status, status, actor); err != nil {
+		respondTransitionError(c, err, order, status)
+		return
+	}
+
+	change := newStatusChange(status, actor, authActorID(auth_user))
+	if err := h.transitionOrder(order, change, update_fields); err != nil {
+		respondTransitionError(c, err, order, status)
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"status_code": http.StatusOK,
-		"message":     "Status do pedido atualizado com sucesso",
+		"status_code":    http.StatusOK,
+		"message":        "Status do pedido atualizado com sucesso",
+		"status":         status.String(),
+		"status_history": append(order.StatusHistory, change),
 	})
 }
@@ -0,0 +1,217 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultOrdersPageSize = 50
+	maxOrdersPageSize     = 200
+)
+
+// OrdersPage é a resposta paginada das listagens de pedidos. Para a próxima
+// página basta repetir a consulta com cursor=next_cursor.
+type OrdersPage struct {
+	Orders     []OrderResponse `json:"orders"`
+	NextCursor string          `json:"next_cursor,omitempty"`
+	HasMore    bool            `json:"has_more"`
+}
+
+// orderCursor aponta para o último pedido da página. A ordenação é por
+// created_at e _id decrescentes, então o _id desempata pedidos do mesmo
+// instante e a paginação fica estável.
+type orderCursor struct {
+	CreatedAt time.Time `json:"created_at"`
+	ID        int       `json:"id"`
+}
+
+func (cursor orderCursor) encode() string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeOrderCursor(value string) (orderCursor, bool) {
+	var cursor orderCursor
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return cursor, false
+	}
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return cursor, false
+	}
+	return cursor, true
+}
+
+// OrderQueryError é um parâmetro de consulta inválido; a mensagem vai na
+// resposta 400.
+type OrderQueryError struct {
+	Message string
+}
+
+func (e *OrderQueryError) Error() string {
+	return e.Message
+}
+
+// orderListQuery lê os filtros comuns às listagens de pedidos:
+//
+//	from, to       datas (2006-01-02, no fuso informado, ou RFC3339); to é inclusivo
+//	status         lista de status separados por vírgula, ex: status=0,1
+//	payment_type   forma de pagamento
+//	delivery_type  tipo de entrega
+//	q              busca no nome ou telefone do cliente
+//	limit, cursor  paginação
+type orderListQuery struct {
+	Filter bson.D
+	Limit  int64
+}
+
+func parseOrderListQuery(c *gin.Context, location *time.Location) (orderListQuery, error) {
+	query := orderListQuery{Filter: bson.D{}, Limit: defaultOrdersPageSize}
+	conditions := bson.A{}
+
+	created_at := bson.D{}
+	if from, exists := c.GetQuery("from"); exists {
+		t, _, err := parseOrderQueryDate(from, location)
+		if err != nil {
+			return query, &OrderQueryError{Message: "Data inicial inválida"}
+		}
+		created_at = append(created_at, bson.E{Key: "$gte", Value: t})
+	}
+	if to, exists := c.GetQuery("to"); exists {
+		t, date_only, err := parseOrderQueryDate(to, location)
+		if err != nil {
+			return query, &OrderQueryError{Message: "Data final inválida"}
+		}
+		// Uma data sem horário inclui o dia inteiro
+		if date_only {
+			created_at = append(created_at, bson.E{Key: "$lt", Value: t.AddDate(0, 0, 1)})
+		} else {
+			created_at = append(created_at, bson.E{Key: "$lte", Value: t})
+		}
+	}
+	if len(created_at) > 0 {
+		query.Filter = append(query.Filter, bson.E{Key: "created_at", Value: created_at})
+	}
+
+	if status_str := c.Query("status"); status_str != "" {
+		statuses := make([]OrderStatus, 0)
+		for _, part := range strings.Split(status_str, ",") {
+			value, err := strconv.Atoi(strings.TrimSpace(part))
+			if err != nil || !OrderStatus(value).IsValid() {
+				return query, &OrderQueryError{Message: "Status de pedido inválido"}
+			}
+			statuses = append(statuses, OrderStatus(value))
+		}
+		query.Filter = append(query.Filter, bson.E{Key: "status", Value: bson.D{{Key: "$in", Value: statuses}}})
+	}
+
+	if payment_type := c.Query("payment_type"); payment_type != "" {
+		query.Filter = append(query.Filter, bson.E{Key: "payment_type", Value: payment_type})
+	}
+	if delivery_type := c.Query("delivery_type"); delivery_type != "" {
+		query.Filter = append(query.Filter, bson.E{Key: "delivery_type", Value: delivery_type})
+	}
+
+	if search := strings.TrimSpace(c.Query("q")); search != "" {
+		search_conditions := bson.A{
+			bson.D{{Key: "user.name", Value: containsInsensitive(regexp.QuoteMeta(search))}},
+		}
+		if digits := onlyDigits(search); digits != "" {
+			search_conditions = append(search_conditions, bson.D{{Key: "user.phone_number", Value: containsInsensitive(digits)}})
+		}
+		conditions = append(conditions, bson.D{{Key: "$or", Value: search_conditions}})
+	}
+
+	if limit_str := c.Query("limit"); limit_str != "" {
+		limit, err := strconv.Atoi(limit_str)
+		if err != nil || limit < 1 {
+			return query, &OrderQueryError{Message: "Limite de pedidos inválido"}
+		}
+		if limit > maxOrdersPageSize {
+			limit = maxOrdersPageSize
+		}
+		query.Limit = int64(limit)
+	}
+
+	if cursor_str := c.Query("cursor"); cursor_str != "" {
+		cursor, ok := decodeOrderCursor(cursor_str)
+		if !ok {
+			return query, &OrderQueryError{Message: "Cursor de paginação inválido"}
+		}
+		conditions = append(conditions, bson.D{{Key: "$or", Value: bson.A{
+			bson.D{{Key: "created_at", Value: bson.D{{Key: "$lt", Value: cursor.CreatedAt}}}},
+			bson.D{
+				{Key: "created_at", Value: cursor.CreatedAt},
+				{Key: "_id", Value: bson.D{{Key: "$lt", Value: cursor.ID}}},
+			},
+		}}})
+	}
+
+	if len(conditions) > 0 {
+		query.Filter = append(query.Filter, bson.E{Key: "$and", Value: conditions})
+	}
+	return query, nil
+}
+
+// HasDateRange indica se a consulta já trouxe from ou to.
+func (q orderListQuery) HasDateRange() bool {
+	for _, e := range q.Filter {
+		if e.Key == "created_at" {
+			return true
+		}
+	}
+	return false
+}
+
+// FindOptions ordena de forma estável e busca um pedido a mais que o limite
+// para saber se existe próxima página.
+func (q orderListQuery) FindOptions() *options.FindOptions {
+	return options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}).
+		SetLimit(q.Limit + 1)
+}
+
+// Page corta a página no limite e monta o cursor da próxima.
+func (q orderListQuery) Page(orders []Order, responses []OrderResponse) OrdersPage {
+	page := OrdersPage{Orders: responses}
+	if int64(len(responses)) > q.Limit {
+		page.Orders = responses[:q.Limit]
+		last := orders[q.Limit-1]
+		page.HasMore = true
+		page.NextCursor = orderCursor{CreatedAt: last.CreatedAt, ID: last.ID}.encode()
+	}
+	return page
+}
+
+// parseOrderQueryDate aceita RFC3339 ou só a data, no fuso informado; date_only
+// indica o segundo caso, em que t é o início do dia.
+func parseOrderQueryDate(value string, location *time.Location) (t time.Time, date_only bool, err error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, false, nil
+	}
+	t, err = time.ParseInLocation("2006-01-02", value, location)
+	return t, err == nil, err
+}
+
+func containsInsensitive(pattern string) bson.D {
+	return bson.D{{Key: "$regex", Value: pattern}, {Key: "$options", Value: "i"}}
+}
+
+func onlyDigits(value string) string {
+	var digits strings.Builder
+	for _, r := range value {
+		if r >= '0' && r <= '9' {
+			digits.WriteRune(r)
+		}
+	}
+	return digits.String()
+}
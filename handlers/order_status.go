@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	ActorCustomer = "customer"
+	ActorPartner  = "partner"
+	ActorCourier  = "courier"
+	ActorAdmin    = "admin"
+)
+
+// StatusChange é uma entrada do histórico de status do pedido.
+type StatusChange struct {
+	Status      OrderStatus `bson:"status" json:"status"`
+	Description string      `bson:"description" json:"description"`
+	Actor       string      `bson:"actor" json:"actor,omitempty"`
+	ActorID     string      `bson:"actor_id" json:"actor_id,omitempty"`
+	ChangedAt   time.Time   `bson:"changed_at" json:"changed_at"`
+}
+
+// orderTransitions lista, para cada status, os próximos status possíveis e
+// quem pode fazer cada transição. O admin pode fazer qualquer transição
+// permitida, mas nunca pular a máquina de estados.
+var orderTransitions = map[OrderStatus]map[OrderStatus][]string{
+	OrderSent: {
+		OrderConfirmed: {ActorPartner},
+		OrderRejected:  {ActorPartner},
+		OrderCancelled: {ActorCustomer, ActorPartner},
+	},
+	OrderConfirmed: {
+		OrderOutForDelivery: {ActorPartner, ActorCourier},
+		// Pedidos para retirada são entregues direto no balcão
+		OrderDelivered: {ActorPartner},
+		OrderCancelled: {ActorPartner},
+	},
+	OrderOutForDelivery: {
+		OrderDelivered: {ActorPartner, ActorCourier},
+	},
+}
+
+var (
+	errTransitionNotAllowed = errors.New("transição de status não permitida")
+	errActorNotAllowed      = errors.New("ator não pode fazer essa transição")
+)
+
+func checkOrderTransition(from, to OrderStatus, actor string) error {
+	actors, exists := orderTransitions[from][to]
+	if !exists {
+		return errTransitionNotAllowed
+	}
+	if actor == ActorAdmin {
+		return nil
+	}
+	for _, allowed := range actors {
+		if allowed == actor {
+			return nil
+		}
+	}
+	return errActorNotAllowed
+}
+
+func orderActor(u *AuthUser) string {
+	switch u.Role {
+	case RoleAdmin:
+		return ActorAdmin
+	case RolePartner:
+		return ActorPartner
+	case RoleCourier:
+		return ActorCourier
+	}
+	return ActorCustomer
+}
+
+func newStatusChange(status OrderStatus, actor, actor_id string) StatusChange {
+	return StatusChange{
+		Status:      status,
+		Description: status.String(),
+		Actor:       actor,
+		ActorID:     actor_id,
+		ChangedAt:   time.Now(),
+	}
+}
+
+func authActorID(u *AuthUser) string {
+	switch u.Role {
+	case RoleCourier:
+		return strconv.Itoa(u.DeliveryID)
+	case RolePartner:
+		return strconv.Itoa(u.PartnerID)
+	}
+	return u.ID.Hex()
+}
+
+// orderScopeFilter restringe o pedido ao que o usuário autenticado pode ver:
+// o cliente só os próprios pedidos, o parceiro os do seu restaurante e o
+// entregador os do seu restaurante atribuídos a ele.
+func orderScopeFilter(u *AuthUser, order_id int) bson.D {
+	filter := bson.D{{Key: "_id", Value: order_id}}
+	switch u.Role {
+	case RoleClient:
+		filter = append(filter, bson.E{Key: "user._id", Value: u.ID})
+	case RolePartner:
+		filter = append(filter, bson.E{Key: "partner_id", Value: u.PartnerID})
+	case RoleCourier:
+		filter = append(filter,
+			bson.E{Key: "partner_id", Value: u.PartnerID},
+			// Pedidos sem entregador têm delivery_id 0
+			bson.E{Key: "delivery_id", Value: bson.D{{Key: "$eq", Value: u.DeliveryID}, {Key: "$ne", Value: 0}}},
+		)
+	}
+	return filter
+}
+
+// transitionOrder aplica a mudança de status de forma atômica: o filtro inclui
+// o status lido, então duas atualizações simultâneas não passam as duas.
+func (h *Handlers) transitionOrder(order Order, change StatusChange, extra bson.D) error {
+	collection := h.database.Collection("Orders")
+	filter := bson.D{
+		{Key: "_id", Value: order.ID},
+		{Key: "status", Value: order.Status},
+	}
+	set := bson.D{
+		{Key: "status", Value: change.Status},
+		{Key: "updated_at", Value: time.Now()},
+	}
+	set = append(set, extra...)
+	update := bson.D{
+		{Key: "$set", Value: set},
+		{Key: "$push", Value: bson.D{{Key: "status_history", Value: change}}},
+	}
+
+	result, err := collection.UpdateOne(h.context, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errTransitionNotAllowed
+	}
+	if change.Status == OrderCancelled || change.Status == OrderRejected {
+		h.releaseOrderSlot(order.ScheduleSlotID)
+		h.releaseOrderCoupon(order)
+	}
+	return nil
+}
+
+func (h *Handlers) findScopedOrder(c *gin.Context, order_id int) (Order, bool) {
+	var order Order
+	collection := h.database.Collection("Orders")
+	err := collection.FindOne(h.context, orderScopeFilter(getAuthUser(c), order_id)).Decode(&order)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status_code": http.StatusNotFound,
+			"message":     "Pedido não encontrado",
+		})
+		return order, false
+	}
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível carregar o pedido",
+		})
+		return order, false
+	}
+	return order, true
+}
+
+func respondTransitionError(c *gin.Context, err error, order Order, to OrderStatus) {
+	switch {
+	case errors.Is(err, errActorNotAllowed):
+		c.JSON(http.StatusForbidden, gin.H{
+			"status_code": http.StatusForbidden,
+			"message":     "Você não tem permissão para mudar o pedido para " + to.String(),
+		})
+	case errors.Is(err, errTransitionNotAllowed):
+		c.JSON(http.StatusConflict, gin.H{
+			"status_code": http.StatusConflict,
+			"message":     "Não é possível mudar o pedido de " + order.Status.String() + " para " + to.String(),
+		})
+	default:
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível atualizar o status do pedido",
+		})
+	}
+}
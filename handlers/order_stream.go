@@ -0,0 +1,436 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sergingroisman/meal-maker-functions/cmd/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	OrderEventCreated       = "order_created"
+	OrderEventStatusChanged = "order_status_changed"
+	OrderEventSnapshot      = "order_snapshot"
+)
+
+// OrderEvent é o evento enviado pelos streams de pedidos. O ID vai no campo
+// "id" do SSE e volta no Last-Event-ID quando o cliente reconecta.
+type OrderEvent struct {
+	ID          string          `json:"-"`
+	Type        string          `json:"type"`
+	OrderID     int             `json:"order_id"`
+	Status      OrderStatus     `json:"status"`
+	Description string          `json:"description"`
+	Change      *StatusChange   `json:"change,omitempty"`
+	History     []StatusChange  `json:"history,omitempty"`
+	Order       *Order          `json:"order,omitempty"`
+	Courier     *CourierContact `json:"courier,omitempty"`
+	At          time.Time       `json:"at"`
+
+	deliveryID int
+}
+
+// orderEventID monta o id do evento como "<unix nanos>" ou, quando vem de um
+// change stream, "<unix nanos>:<resume token>". O horário permite retomar
+// pelo polling mesmo quando o token não serve mais.
+func orderEventID(at time.Time, resume_token string) string {
+	id := strconv.FormatInt(at.UnixNano(), 10)
+	if resume_token != "" {
+		id += ":" + resume_token
+	}
+	return id
+}
+
+func parseOrderEventID(id string) (time.Time, string, bool) {
+	if id == "" {
+		return time.Time{}, "", false
+	}
+	nanos_str, resume_token, _ := strings.Cut(id, ":")
+	nanos, err := strconv.ParseInt(nanos_str, 10, 64)
+	if err != nil {
+		return time.Time{}, "", false
+	}
+	return time.Unix(0, nanos), resume_token, true
+}
+
+func newOrderCreatedEvent(order Order, at time.Time) OrderEvent {
+	order.User.Password = ""
+	return OrderEvent{
+		Type:        OrderEventCreated,
+		OrderID:     order.ID,
+		Status:      order.Status,
+		Description: order.Status.String(),
+		Order:       &order,
+		At:          at,
+		deliveryID:  order.DeliveryID,
+	}
+}
+
+// heldUntilVisible diz se o evento, de um pedido agendado, aconteceu antes de
+// o pedido entrar no feed da cozinha. Esses eventos não vão para o stream do
+// parceiro; o pedido aparece como novo em visible_at (ver pollVisibleOrders).
+func heldUntilVisible(order Order, at time.Time) bool {
+	return order.ScheduledFor != nil && order.VisibleAt.After(at)
+}
+
+// finishedBefore diz se o pedido foi cancelado ou recusado até t.
+func finishedBefore(order Order, t time.Time) bool {
+	for _, change := range order.StatusHistory {
+		if change.ChangedAt.After(t) {
+			break
+		}
+		if change.Status == OrderCancelled || change.Status == OrderRejected {
+			return true
+		}
+	}
+	return false
+}
+
+func newOrderStatusEvent(order Order, change StatusChange) OrderEvent {
+	return OrderEvent{
+		Type:        OrderEventStatusChanged,
+		OrderID:     order.ID,
+		Status:      change.Status,
+		Description: change.Status.String(),
+		Change:      &change,
+		At:          change.ChangedAt,
+		deliveryID:  order.DeliveryID,
+	}
+}
+
+// GetOrdersStreamByPartnerID envia por SSE os pedidos novos e as mudanças de
+// status do parceiro, substituindo o polling do feed da cozinha. Como no feed,
+// pedidos agendados só chegam quando passa o visible_at.
+func (h *Handlers) GetOrdersStreamByPartnerID(c *gin.Context) {
+	partner_id_str := c.Param("partner_id")
+	if partner_id_str == "" {
+		c.IndentedJSON(http.StatusBadRequest, "Necessário passar o id do parceiro como parâmetro")
+		return
+	}
+
+	partner_id, err := strconv.Atoi(partner_id_str)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Formato de id inválido",
+		})
+		return
+	}
+
+	h.streamOrderEvents(c, bson.D{{Key: "partner_id", Value: partner_id}}, nil, nil, true)
+}
+
+// streamOrderEvents mantém a conexão SSE aberta enviando os eventos dos
+// pedidos que atendem ao filtro. Usa change streams quando o Mongo é replica
+// set e cai para polling quando não é. O snapshot, quando informado, é enviado
+// logo na conexão; view adapta cada evento antes do envio. Com hold_scheduled,
+// os pedidos agendados ficam retidos até o visible_at, como no feed da cozinha.
+func (h *Handlers) streamOrderEvents(c *gin.Context, filter bson.D, snapshot *OrderEvent, view func(OrderEvent) OrderEvent, hold_scheduled bool) {
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	last_event_id := c.GetHeader("Last-Event-ID")
+	if last_event_id == "" {
+		last_event_id = c.Query("last_event_id")
+	}
+	since, resume_token, resuming := parseOrderEventID(last_event_id)
+	from_since := resuming
+	if !resuming {
+		since = time.Now()
+		// Eventos entre a leitura do snapshot e o início do stream não se perdem
+		if snapshot != nil {
+			since = snapshot.At
+			from_since = true
+		}
+	}
+
+	// Quando um dos produtores termina, o cancel encerra o outro e a conexão;
+	// o cliente reconecta pelo Last-Event-ID
+	events := make(chan OrderEvent)
+	var producers sync.WaitGroup
+	producers.Add(1)
+	go func() {
+		defer producers.Done()
+		defer cancel()
+		err := h.watchOrderEvents(ctx, filter, since, resume_token, from_since, hold_scheduled, events)
+		if errors.Is(err, errChangeStreamUnavailable) {
+			log.Println("Change stream indisponível, usando polling:", err.Error())
+			err = h.pollOrderEvents(ctx, filter, since, hold_scheduled, events)
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Println(err.Error())
+		}
+	}()
+	if hold_scheduled {
+		producers.Add(1)
+		go func() {
+			defer producers.Done()
+			defer cancel()
+			err := h.pollVisibleOrders(ctx, filter, since, events)
+			if err != nil && ctx.Err() == nil {
+				log.Println(err.Error())
+			}
+		}()
+	}
+	go func() {
+		producers.Wait()
+		close(events)
+	}()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	write := func(event OrderEvent) {
+		if view != nil {
+			event = view(event)
+		}
+		data, err := json.Marshal(event)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		fmt.Fprintf(c.Writer, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+		c.Writer.Flush()
+	}
+
+	if snapshot != nil && !resuming {
+		write(*snapshot)
+	}
+
+	heartbeat := time.NewTicker(config.Env.Stream.HeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(c.Writer, ": ping\n\n")
+			c.Writer.Flush()
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			write(event)
+		}
+	}
+}
+
+var errChangeStreamUnavailable = errors.New("change stream indisponível")
+
+type orderChangeEvent struct {
+	OperationType     string `bson:"operationType"`
+	FullDocument      Order  `bson:"fullDocument"`
+	UpdateDescription struct {
+		UpdatedFields bson.M `bson:"updatedFields"`
+	} `bson:"updateDescription"`
+}
+
+// watchOrderEvents lê o change stream da collection Orders. Retorna
+// errChangeStreamUnavailable, sem enviar nada, quando o Mongo não suporta
+// change streams.
+func (h *Handlers) watchOrderEvents(ctx context.Context, filter bson.D, since time.Time, resume_token string, from_since bool, hold_scheduled bool, events chan<- OrderEvent) error {
+	match := bson.D{{Key: "operationType", Value: bson.D{{Key: "$in", Value: bson.A{"insert", "update", "replace"}}}}}
+	for _, e := range filter {
+		match = append(match, bson.E{Key: "fullDocument." + e.Key, Value: e.Value})
+	}
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: match}}}
+
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if resume_token != "" {
+		opts.SetResumeAfter(bson.D{{Key: "_data", Value: resume_token}})
+	} else if from_since {
+		opts.SetStartAtOperationTime(&primitive.Timestamp{T: uint32(since.Unix())})
+	}
+
+	stream, err := h.database.Collection("Orders").Watch(ctx, pipeline, opts)
+	if err != nil && resume_token != "" {
+		// O token pode ter saído do oplog; tenta de novo pelo horário do evento
+		opts.SetResumeAfter(nil)
+		opts.SetStartAtOperationTime(&primitive.Timestamp{T: uint32(since.Unix())})
+		stream, err = h.database.Collection("Orders").Watch(ctx, pipeline, opts)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s", errChangeStreamUnavailable, err.Error())
+	}
+	defer stream.Close(context.Background())
+
+	for stream.Next(ctx) {
+		var change orderChangeEvent
+		if err := stream.Decode(&change); err != nil {
+			log.Println(err.Error())
+			continue
+		}
+		token, _ := stream.ResumeToken().Lookup("_data").StringValueOK()
+
+		var event OrderEvent
+		switch change.OperationType {
+		case "insert":
+			at := time.Now()
+			if history := change.FullDocument.StatusHistory; len(history) > 0 {
+				at = history[0].ChangedAt
+			}
+			if hold_scheduled && heldUntilVisible(change.FullDocument, at) {
+				continue
+			}
+			event = newOrderCreatedEvent(change.FullDocument, at)
+		default:
+			if _, changed := change.UpdateDescription.UpdatedFields["status"]; !changed && change.OperationType == "update" {
+				continue
+			}
+			history := change.FullDocument.StatusHistory
+			if len(history) == 0 {
+				continue
+			}
+			if hold_scheduled && heldUntilVisible(change.FullDocument, history[len(history)-1].ChangedAt) {
+				continue
+			}
+			event = newOrderStatusEvent(change.FullDocument, history[len(history)-1])
+		}
+		event.ID = orderEventID(event.At, token)
+
+		select {
+		case events <- event:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return stream.Err()
+}
+
+// pollOrderEvents é o modo sem change streams: consulta periodicamente o
+// histórico de status dos pedidos e envia as entradas mais novas que since.
+func (h *Handlers) pollOrderEvents(ctx context.Context, filter bson.D, since time.Time, hold_scheduled bool, events chan<- OrderEvent) error {
+	ticker := time.NewTicker(config.Env.Stream.PollInterval)
+	defer ticker.Stop()
+
+	collection := h.database.Collection("Orders")
+	for {
+		query := append(bson.D{}, filter...)
+		query = append(query, bson.E{Key: "status_history.changed_at", Value: bson.D{{Key: "$gt", Value: since}}})
+
+		cursor, err := collection.Find(ctx, query)
+		if err != nil {
+			return err
+		}
+
+		batch := make([]OrderEvent, 0)
+		for cursor.Next(ctx) {
+			var order Order
+			if err := cursor.Decode(&order); err != nil {
+				log.Println(err.Error())
+				continue
+			}
+			for i, change := range order.StatusHistory {
+				if !change.ChangedAt.After(since) {
+					continue
+				}
+				if hold_scheduled && heldUntilVisible(order, change.ChangedAt) {
+					continue
+				}
+				if i == 0 {
+					batch = append(batch, newOrderCreatedEvent(order, change.ChangedAt))
+				} else {
+					batch = append(batch, newOrderStatusEvent(order, change))
+				}
+			}
+		}
+		cursor.Close(ctx)
+
+		sort.SliceStable(batch, func(i, j int) bool {
+			return batch[i].At.Before(batch[j].At)
+		})
+		for _, event := range batch {
+			event.ID = orderEventID(event.At, "")
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return nil
+			}
+			since = event.At
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// pollVisibleOrders envia como novos os pedidos agendados cujo visible_at
+// passou depois de since, com o pedido já no estado atual. Pedidos cancelados
+// ou recusados antes disso nunca chegam à cozinha.
+func (h *Handlers) pollVisibleOrders(ctx context.Context, filter bson.D, since time.Time, events chan<- OrderEvent) error {
+	ticker := time.NewTicker(config.Env.Stream.PollInterval)
+	defer ticker.Stop()
+
+	collection := h.database.Collection("Orders")
+	for {
+		now := time.Now()
+		query := append(bson.D{}, filter...)
+		query = append(query,
+			bson.E{Key: "scheduled_for", Value: bson.D{{Key: "$ne", Value: nil}}},
+			bson.E{Key: "visible_at", Value: bson.D{{Key: "$gt", Value: since}, {Key: "$lte", Value: now}}},
+		)
+		opts := options.Find().SetSort(bson.D{{Key: "visible_at", Value: 1}, {Key: "_id", Value: 1}})
+
+		cursor, err := collection.Find(ctx, query, opts)
+		if err != nil {
+			return err
+		}
+
+		batch := make([]OrderEvent, 0)
+		for cursor.Next(ctx) {
+			var order Order
+			if err := cursor.Decode(&order); err != nil {
+				log.Println(err.Error())
+				continue
+			}
+			if len(order.StatusHistory) == 0 || !heldUntilVisible(order, order.StatusHistory[0].ChangedAt) {
+				continue
+			}
+			if finishedBefore(order, order.VisibleAt) {
+				continue
+			}
+			batch = append(batch, newOrderCreatedEvent(order, order.VisibleAt))
+		}
+		cursor.Close(ctx)
+
+		for _, event := range batch {
+			event.ID = orderEventID(event.At, "")
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		since = now
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
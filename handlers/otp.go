@@ -0,0 +1,444 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/sergingroisman/meal-maker-functions/cmd/config"
+	"github.com/sergingroisman/meal-maker-functions/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	OTPPurposeSignUp = "sign-up"
+	OTPPurposeSignIn = "sign-in"
+)
+
+// OneTimeCode é um código enviado por SMS/WhatsApp. O código em si nunca é
+// gravado, apenas um HMAC dele.
+type OneTimeCode struct {
+	ID                    primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	PhoneNumber           string             `bson:"phone_number" json:"phone_number"`
+	Purpose               string             `bson:"purpose" json:"purpose"`
+	CodeHash              string             `bson:"code_hash" json:"-"`
+	Attempts              int                `bson:"attempts" json:"attempts"`
+	VerifiedAt            *time.Time         `bson:"verified_at,omitempty" json:"verified_at,omitempty"`
+	VerificationTokenHash string             `bson:"verification_token_hash,omitempty" json:"-"`
+	ConsumedAt            *time.Time         `bson:"consumed_at,omitempty" json:"consumed_at,omitempty"`
+	ExpiresAt             time.Time          `bson:"expires_at" json:"expires_at"`
+	CreatedAt             time.Time          `bson:"created_at" json:"created_at"`
+}
+
+type OTPRequestReqBody struct {
+	PhoneNumber string `bson:"phone_number" json:"phone_number" validate:"required"`
+	Purpose     string `bson:"purpose" json:"purpose" validate:"required,oneof=sign-up sign-in"`
+	Channel     string `bson:"channel" json:"channel" validate:"omitempty,oneof=sms whatsapp"`
+}
+
+type OTPVerifyReqBody struct {
+	PhoneNumber string `bson:"phone_number" json:"phone_number" validate:"required"`
+	Purpose     string `bson:"purpose" json:"purpose" validate:"required,oneof=sign-up sign-in"`
+	Code        string `bson:"code" json:"code" validate:"required,len=6,numeric"`
+}
+
+type SignInOTPReqBody struct {
+	PhoneNumber string `bson:"phone_number" json:"phone_number" validate:"required"`
+	Code        string `bson:"code" json:"code" validate:"required,len=6,numeric"`
+}
+
+var (
+	errOTPNotFound        = errors.New("otp not found or expired")
+	errOTPTooManyAttempts = errors.New("otp max attempts reached")
+	errOTPInvalid         = errors.New("otp does not match")
+)
+
+func (h *Handlers) RequestOTP(c *gin.Context) {
+	if !h.senderAvailable(c) {
+		return
+	}
+
+	body := OTPRequestReqBody{}
+	if err := c.ShouldBindBodyWithJSON(&body); err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Não foi possível processar esse número de telefone",
+		})
+		return
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(&body); err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Formulário não está válido",
+		})
+		return
+	}
+
+	phone_number, ok := normalizePhoneNumber(body.PhoneNumber)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Número de telefone inválido",
+		})
+		return
+	}
+
+	collection := h.database.Collection("OneTimeCodes")
+
+	var last OneTimeCode
+	filter := bson.D{
+		{Key: "phone_number", Value: phone_number},
+		{Key: "purpose", Value: body.Purpose},
+	}
+	opts := options.FindOne().SetSort(bson.D{{Key: "_id", Value: -1}})
+	err := collection.FindOne(h.context, filter, opts).Decode(&last)
+	if err == nil && time.Since(last.ID.Timestamp()) < config.Env.OTP.ResendInterval {
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"status_code": http.StatusTooManyRequests,
+			"message":     "Aguarde alguns segundos antes de pedir um novo código",
+		})
+		return
+	}
+
+	code, err := newOTPCode()
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível gerar o código de verificação",
+		})
+		return
+	}
+
+	// Só o código mais recente de cada telefone/finalidade é válido
+	_, err = collection.DeleteMany(h.context, filter)
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	otp := OneTimeCode{
+		ID:          primitive.NewObjectID(),
+		PhoneNumber: phone_number,
+		Purpose:     body.Purpose,
+		ExpiresAt:   time.Now().Add(config.Env.OTP.TTL),
+		CreatedAt:   time.Now(),
+	}
+	otp.CodeHash = hashOTPCode(otp.ID, code)
+
+	_, err = collection.InsertOne(h.context, otp)
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível gerar o código de verificação",
+		})
+		return
+	}
+
+	channel := body.Channel
+	if channel == "" {
+		channel = ChannelSMS
+	}
+	err = h.sender.Send(h.context, Message{
+		PhoneNumber: phone_number,
+		Channel:     channel,
+		Body:        fmt.Sprintf("Seu código de verificação Meal Maker é %s. Ele expira em %d minutos.", code, int(config.Env.OTP.TTL.Minutes())),
+	})
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusBadGateway, gin.H{
+			"status_code": http.StatusBadGateway,
+			"message":     "Não foi possível enviar o código de verificação",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status_code": http.StatusOK,
+		"message":     "Código de verificação enviado",
+		"expires_in":  int64(config.Env.OTP.TTL.Seconds()),
+	})
+}
+
+// VerifyOTP confirma o código e devolve um verification_token de uso único,
+// exigido pelo SignUp quando OTP_REQUIRED_ON_SIGN_UP está ativo.
+func (h *Handlers) VerifyOTP(c *gin.Context) {
+	body := OTPVerifyReqBody{}
+	if err := c.ShouldBindBodyWithJSON(&body); err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Não foi possível processar esse código",
+		})
+		return
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(&body); err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Formulário não está válido",
+		})
+		return
+	}
+
+	phone_number, ok := normalizePhoneNumber(body.PhoneNumber)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Número de telefone inválido",
+		})
+		return
+	}
+
+	otp, err := h.checkOTP(phone_number, body.Purpose, body.Code)
+	if err != nil {
+		respondOTPError(c, err)
+		return
+	}
+
+	verification_token, err := newRefreshToken()
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível validar o código",
+		})
+		return
+	}
+
+	collection := h.database.Collection("OneTimeCodes")
+	filter := bson.D{{Key: "_id", Value: otp.ID}}
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "verification_token_hash", Value: hashRefreshToken(verification_token)},
+		{Key: "expires_at", Value: time.Now().Add(config.Env.OTP.TTL)},
+	}}}
+	_, err = collection.UpdateOne(h.context, filter, update)
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível validar o código",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status_code":        http.StatusOK,
+		"message":            "Telefone verificado com sucesso",
+		"verification_token": verification_token,
+	})
+}
+
+func (h *Handlers) SignInWithOTP(c *gin.Context) {
+	body := SignInOTPReqBody{}
+	if err := c.ShouldBindBodyWithJSON(&body); err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Não foi possível processar esse número de telefone e código",
+		})
+		return
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(&body); err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Formulário não está válido",
+		})
+		return
+	}
+
+	phone_number, ok := normalizePhoneNumber(body.PhoneNumber)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Número de telefone inválido",
+		})
+		return
+	}
+
+	if !h.checkAuthLockout(c, phone_number) {
+		return
+	}
+
+	_, err := h.checkOTP(phone_number, OTPPurposeSignIn, body.Code)
+	if err != nil {
+		if errors.Is(err, errOTPInvalid) {
+			h.registerAuthFailure(c, phone_number)
+		}
+		respondOTPError(c, err)
+		return
+	}
+	h.clearAuthFailures(phone_number)
+
+	var user User
+	collection := h.database.Collection("Users")
+	filter := bson.D{{Key: "phone_number", Value: phone_number}}
+	err = collection.FindOne(h.context, filter).Decode(&user)
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Não foi possível encontrar esse usuário pelo número de telefone",
+		})
+		return
+	}
+
+	if !user.PhoneVerified {
+		update := bson.D{{Key: "$set", Value: bson.D{
+			{Key: "phone_verified", Value: true},
+			{Key: "updated_at", Value: time.Now()},
+		}}}
+		if _, err := collection.UpdateOne(h.context, bson.D{{Key: "_id", Value: user.ID}}, update); err != nil {
+			log.Println(err.Error())
+		}
+	}
+
+	res, err := h.startSession(c, user)
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Não foi possível criar um token de acesso",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status_code": http.StatusOK,
+		"loggedIn":    res,
+	})
+}
+
+// checkOTP valida o código e o marca como verificado. Cada tentativa é
+// contada antes da comparação, então requisições concorrentes não conseguem
+// passar de OTP_MAX_ATTEMPTS.
+func (h *Handlers) checkOTP(phone_number, purpose, code string) (OneTimeCode, error) {
+	collection := h.database.Collection("OneTimeCodes")
+
+	var otp OneTimeCode
+	filter := bson.D{
+		{Key: "phone_number", Value: phone_number},
+		{Key: "purpose", Value: purpose},
+		{Key: "verified_at", Value: bson.D{{Key: "$exists", Value: false}}},
+		{Key: "expires_at", Value: bson.D{{Key: "$gt", Value: time.Now()}}},
+	}
+	attempt_filter := append(bson.D{}, filter...)
+	attempt_filter = append(attempt_filter, bson.E{Key: "attempts", Value: bson.D{{Key: "$lt", Value: config.Env.OTP.MaxAttempts}}})
+	update := bson.D{{Key: "$inc", Value: bson.D{{Key: "attempts", Value: 1}}}}
+	err := collection.FindOneAndUpdate(h.context, attempt_filter, update).Decode(&otp)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		if count, _ := collection.CountDocuments(h.context, filter); count > 0 {
+			return otp, errOTPTooManyAttempts
+		}
+		return otp, errOTPNotFound
+	}
+	if err != nil {
+		return otp, err
+	}
+
+	if !hmac.Equal([]byte(otp.CodeHash), []byte(hashOTPCode(otp.ID, code))) {
+		return otp, errOTPInvalid
+	}
+
+	// O filtro por verified_at impede que o mesmo código seja usado duas vezes
+	// em requisições concorrentes.
+	now := time.Now()
+	result, err := collection.UpdateOne(h.context, bson.D{
+		{Key: "_id", Value: otp.ID},
+		{Key: "verified_at", Value: bson.D{{Key: "$exists", Value: false}}},
+	}, bson.D{{Key: "$set", Value: bson.D{{Key: "verified_at", Value: now}}}})
+	if err != nil {
+		return otp, err
+	}
+	if result.ModifiedCount == 0 {
+		return otp, errOTPNotFound
+	}
+
+	otp.VerifiedAt = &now
+	return otp, nil
+}
+
+// consumeVerificationToken marca como usado o verification_token emitido pelo
+// VerifyOTP para o telefone informado.
+func (h *Handlers) consumeVerificationToken(phone_number, verification_token string) error {
+	collection := h.database.Collection("OneTimeCodes")
+	filter := bson.D{
+		{Key: "phone_number", Value: phone_number},
+		{Key: "purpose", Value: OTPPurposeSignUp},
+		{Key: "verification_token_hash", Value: hashRefreshToken(verification_token)},
+		{Key: "consumed_at", Value: bson.D{{Key: "$exists", Value: false}}},
+		{Key: "expires_at", Value: bson.D{{Key: "$gt", Value: time.Now()}}},
+	}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "consumed_at", Value: time.Now()}}}}
+	result, err := collection.UpdateOne(h.context, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.ModifiedCount == 0 {
+		return errOTPNotFound
+	}
+	return nil
+}
+
+func respondOTPError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errOTPTooManyAttempts):
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"status_code": http.StatusTooManyRequests,
+			"message":     "Número máximo de tentativas atingido, peça um novo código",
+		})
+	case errors.Is(err, errOTPNotFound), errors.Is(err, errOTPInvalid):
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Código de verificação inválido ou expirado",
+		})
+	default:
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível validar o código",
+		})
+	}
+}
+
+// normalizePhoneNumber é o formato de telefone gravado nos usuários; a regra
+// fica em database para ser a mesma da migração normalize-phones.
+func normalizePhoneNumber(phone_number string) (string, bool) {
+	return database.NormalizePhoneNumber(phone_number)
+}
+
+func newOTPCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+func hashOTPCode(otp_id primitive.ObjectID, code string) string {
+	mac := hmac.New(sha256.New, []byte(config.Env.Auth.SecretKey))
+	mac.Write(otp_id[:])
+	mac.Write([]byte(code))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// resolveUserID devolve o usuário alvo da requisição: o :user_id da rota ou,
+// nas rotas /me, o próprio usuário autenticado. Quando o chamador não é dono
+// do recurso nem admin, a resposta de erro já é enviada e ok é false.
+func resolveUserID(c *gin.Context) (user_id primitive.ObjectID, ok bool) {
+	auth_user := getAuthUser(c)
+	if auth_user == nil {
+		respondForbidden(c)
+		return primitive.NilObjectID, false
+	}
+
+	user_id_str, has_param := c.Params.Get("user_id")
+	if !has_param {
+		return auth_user.ID, true
+	}
+
+	user_id, err := primitive.ObjectIDFromHex(user_id_str)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Formato de ID inválido",
+		})
+		return primitive.NilObjectID, false
+	}
+
+	if !auth_user.CanAccessUser(user_id) {
+		respondForbidden(c)
+		return primitive.NilObjectID, false
+	}
+
+	return user_id, true
+}
+
+// resolvePhoneNumber funciona como resolveUserID para as rotas identificadas
+// pelo :phone_number.
+func resolvePhoneNumber(c *gin.Context) (phone_number string, ok bool) {
+	auth_user := getAuthUser(c)
+	if auth_user == nil {
+		respondForbidden(c)
+		return "", false
+	}
+
+	phone_number, has_param := c.Params.Get("phone_number")
+	if !has_param {
+		return auth_user.PhoneNumber, true
+	}
+
+	if phone_number != auth_user.PhoneNumber && !auth_user.IsAdmin() {
+		respondForbidden(c)
+		return "", false
+	}
+
+	return phone_number, true
+}
+
+func (u *AuthUser) CanAccessUser(user_id primitive.ObjectID) bool {
+	return u != nil && (u.ID == user_id || u.IsAdmin())
+}
+
+func respondForbidden(c *gin.Context) {
+	c.JSON(http.StatusForbidden, gin.H{
+		"status_code": http.StatusForbidden,
+		"message":     "Usuário não tem permissão para acessar esse recurso",
+	})
+}
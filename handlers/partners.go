@@ -1,14 +1,17 @@
 package handlers
 
 import (
+	"errors"
 	"log"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/sergingroisman/meal-maker-functions/cmd/config"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type Schedule struct {
@@ -18,14 +21,19 @@ type Schedule struct {
 }
 
 type Partner struct {
-	ID          primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
-	Name        string             `bson:"name" json:"name"`
-	PartnerID   int                `bson:"partner_id" json:"partner_id"`
-	Logo        string             `bson:"logo" json:"logo"`
-	Schedules   []Schedule         `bson:"schedules" json:"schedules"`
-	DeliveryFee float64            `bson:"delivery_fee" json:"delivery_fee"`
-	CreatedAt   string             `bson:"created_at" json:"created_at"`
-	UpdatedAt   string             `bson:"updated_at" json:"updated_at"`
+	ID             primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	Name           string             `bson:"name" json:"name"`
+	PartnerID      int                `bson:"partner_id" json:"partner_id"`
+	Logo           string             `bson:"logo" json:"logo"`
+	Schedules      []Schedule         `bson:"schedules" json:"schedules"`
+	DeliveryFee    Money              `bson:"delivery_fee" json:"delivery_fee"`
+	Timezone       string             `bson:"timezone" json:"timezone"`
+	City           string             `bson:"city" json:"city"`
+	PixKey         string             `bson:"pix_key" json:"pix_key"`
+	PaymentMethods []string           `bson:"payment_methods" json:"payment_methods"`
+	SlotCapacity   int                `bson:"slot_capacity" json:"slot_capacity"`
+	CreatedAt      time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt      time.Time          `bson:"updated_at" json:"updated_at"`
 }
 
 type PartnerBFFResponse struct {
@@ -34,7 +42,8 @@ type PartnerBFFResponse struct {
 	Logo           string          `json:"logo"`
 	Schedules      []Schedule      `bson:"schedules" json:"schedules"`
 	IsOpen         bool            `json:"is_open"`
-	DeliveryFee    float64         `bson:"delivery_fee" json:"delivery_fee"`
+	DeliveryFee    Money           `bson:"delivery_fee" json:"delivery_fee"`
+	PaymentMethods []PaymentMethod `json:"payment_methods"`
 	Dishes         []Dish          `json:"dishes"`
 	Accompaniments []Accompaniment `json:"accompaniments"`
 }
@@ -117,6 +126,7 @@ func (h *Handlers) GetBFFByPartnerId(c *gin.Context) {
 		IsOpen:         partner.IsOpen(current_time),
 		Schedules:      partner.Schedules,
 		DeliveryFee:    partner.DeliveryFee,
+		PaymentMethods: partner.AcceptedPaymentMethods(h.pixEnabled()),
 		Dishes:         dishes,
 		Accompaniments: accompaniments,
 	}
@@ -124,7 +134,54 @@ func (h *Handlers) GetBFFByPartnerId(c *gin.Context) {
 	c.IndentedJSON(http.StatusOK, partnerBFF)
 }
 
+// Location devolve o fuso horário IANA do parceiro (ex: America/Manaus). Sem
+// fuso configurado, ou com um nome inválido, usa o padrão da aplicação.
+func (partner *Partner) Location() *time.Location {
+	if partner.Timezone != "" {
+		location, err := time.LoadLocation(partner.Timezone)
+		if err == nil {
+			return location
+		}
+		log.Printf("Fuso horário inválido %q do parceiro %d: %s", partner.Timezone, partner.PartnerID, err.Error())
+	}
+	return defaultLocation()
+}
+
+func defaultLocation() *time.Location {
+	location, err := time.LoadLocation(config.Env.Partner.DefaultTimezone)
+	if err != nil {
+		log.Printf("Fuso horário padrão inválido %q: %s", config.Env.Partner.DefaultTimezone, err.Error())
+		return time.UTC
+	}
+	return location
+}
+
+// DayRange devolve o início do dia de t e do dia seguinte no fuso do parceiro.
+func (partner *Partner) DayRange(t time.Time) (time.Time, time.Time) {
+	t = t.In(partner.Location())
+	start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	return start, start.AddDate(0, 0, 1)
+}
+
+func (h *Handlers) findPartner(partner_id int) (Partner, error) {
+	var partner Partner
+	collection := h.database.Collection("Partners")
+	err := collection.FindOne(h.context, bson.D{{Key: "partner_id", Value: partner_id}}).Decode(&partner)
+	return partner, err
+}
+
+// findPartnerForDay é o findPartner das listagens por dia: sem cadastro do
+// parceiro, o dia é calculado no fuso padrão.
+func (h *Handlers) findPartnerForDay(partner_id int) (Partner, error) {
+	partner, err := h.findPartner(partner_id)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return Partner{PartnerID: partner_id}, nil
+	}
+	return partner, err
+}
+
 func (partner *Partner) IsOpen(t time.Time) bool {
+	t = t.In(partner.Location())
 	for _, schedule := range partner.Schedules {
 		startTime, err := time.Parse("15:04", schedule.StartTime)
 		if err != nil {
@@ -0,0 +1,236 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/sergingroisman/meal-maker-functions/cmd/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// PasswordReset é um pedido de troca de senha. Assim como o refresh token,
+// o token de reset só é gravado como hash.
+type PasswordReset struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	UserID    primitive.ObjectID `bson:"user_id" json:"user_id"`
+	TokenHash string             `bson:"token_hash" json:"-"`
+	ExpiresAt time.Time          `bson:"expires_at" json:"expires_at"`
+	UsedAt    *time.Time         `bson:"used_at,omitempty" json:"used_at,omitempty"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
+
+type PasswordResetRequestReqBody struct {
+	PhoneNumber string `bson:"phone_number" json:"phone_number" validate:"required"`
+	Channel     string `bson:"channel" json:"channel" validate:"omitempty,oneof=sms whatsapp"`
+}
+
+type PasswordResetConfirmReqBody struct {
+	Token       string `bson:"token" json:"token" validate:"required"`
+	NewPassword string `bson:"new_password" json:"new_password" validate:"required,min=6"`
+}
+
+// RequestPasswordReset sempre responde com sucesso, exista ou não um usuário
+// com o telefone informado, para não revelar quem tem cadastro.
+func (h *Handlers) RequestPasswordReset(c *gin.Context) {
+	// Antes de buscar o usuário, para a resposta não depender do cadastro
+	if !h.senderAvailable(c) {
+		return
+	}
+
+	body := PasswordResetRequestReqBody{}
+	if err := c.ShouldBindBodyWithJSON(&body); err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Não foi possível processar esse número de telefone",
+		})
+		return
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(&body); err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Formulário não está válido",
+		})
+		return
+	}
+
+	phone_number, ok := normalizePhoneNumber(body.PhoneNumber)
+	if !ok {
+		phone_number = body.PhoneNumber
+	}
+
+	var user User
+	collectionU := h.database.Collection("Users")
+	err := collectionU.FindOne(h.context, bson.D{{Key: "phone_number", Value: phone_number}}).Decode(&user)
+	if err != nil {
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			log.Println(err.Error())
+		}
+		respondPasswordResetRequested(c)
+		return
+	}
+
+	token, err := newRefreshToken()
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível iniciar a recuperação de senha",
+		})
+		return
+	}
+
+	collection := h.database.Collection("PasswordResets")
+
+	// Um novo pedido invalida os anteriores do mesmo usuário
+	_, err = collection.DeleteMany(h.context, bson.D{
+		{Key: "user_id", Value: user.ID},
+		{Key: "used_at", Value: bson.D{{Key: "$exists", Value: false}}},
+	})
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	reset := PasswordReset{
+		ID:        primitive.NewObjectID(),
+		UserID:    user.ID,
+		TokenHash: hashRefreshToken(token),
+		ExpiresAt: time.Now().Add(config.Env.PasswordReset.TTL),
+		CreatedAt: time.Now(),
+	}
+	_, err = collection.InsertOne(h.context, reset)
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível iniciar a recuperação de senha",
+		})
+		return
+	}
+
+	channel := body.Channel
+	if channel == "" {
+		channel = ChannelSMS
+	}
+	err = h.sender.Send(h.context, Message{
+		PhoneNumber: user.PhoneNumber,
+		Channel:     channel,
+		Body:        passwordResetMessage(token),
+	})
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	respondPasswordResetRequested(c)
+}
+
+func (h *Handlers) ConfirmPasswordReset(c *gin.Context) {
+	body := PasswordResetConfirmReqBody{}
+	if err := c.ShouldBindBodyWithJSON(&body); err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Não foi possível processar a nova senha",
+		})
+		return
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(&body); err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Formulário não está válido",
+		})
+		return
+	}
+
+	hashed_password, err := h.hasher.Hash(body.NewPassword)
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível atualizar a senha",
+		})
+		return
+	}
+
+	// Marcar o token como usado antes de trocar a senha garante o uso único
+	// mesmo com duas confirmações simultâneas.
+	var reset PasswordReset
+	collection := h.database.Collection("PasswordResets")
+	filter := bson.D{
+		{Key: "token_hash", Value: hashRefreshToken(body.Token)},
+		{Key: "used_at", Value: bson.D{{Key: "$exists", Value: false}}},
+		{Key: "expires_at", Value: bson.D{{Key: "$gt", Value: time.Now()}}},
+	}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "used_at", Value: time.Now()}}}}
+	err = collection.FindOneAndUpdate(h.context, filter, update).Decode(&reset)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Link de recuperação de senha inválido ou expirado",
+		})
+		return
+	}
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível atualizar a senha",
+		})
+		return
+	}
+
+	collectionU := h.database.Collection("Users")
+	filter_user := bson.D{{Key: "_id", Value: reset.UserID}}
+	update_user := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "password", Value: hashed_password},
+		{Key: "updated_at", Value: time.Now()},
+	}}}
+	result, err := collectionU.UpdateOne(h.context, filter_user, update_user)
+	if err != nil || result.MatchedCount == 0 {
+		if err != nil {
+			log.Println(err.Error())
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível atualizar a senha",
+		})
+		return
+	}
+
+	err = h.revokeSessions(bson.D{{Key: "user_id", Value: reset.UserID}})
+	if err != nil {
+		log.Println("Não foi possível encerrar as sessões após a troca de senha:", err.Error())
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status_code": http.StatusOK,
+		"message":     "Senha atualizada com sucesso",
+	})
+}
+
+func passwordResetMessage(token string) string {
+	if config.Env.PasswordReset.URL != "" {
+		return fmt.Sprintf("Para criar uma nova senha no Meal Maker acesse %s?token=%s", config.Env.PasswordReset.URL, token)
+	}
+	return fmt.Sprintf("Seu código para criar uma nova senha no Meal Maker é %s", token)
+}
+
+func respondPasswordResetRequested(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status_code": http.StatusOK,
+		"message":     "Se o número estiver cadastrado, enviaremos as instruções para recuperar a senha",
+	})
+}
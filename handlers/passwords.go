@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/sergingroisman/meal-maker-functions/cmd/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHasher gera e valida os hashes de senha guardados na collection Users.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	Compare(hashed_password, password string) (bool, error)
+	// NeedsRehash indica se o hash foi gerado com outro algoritmo ou parâmetros
+	// diferentes da configuração atual.
+	NeedsRehash(hashed_password string) bool
+}
+
+var errInvalidHash = errors.New("invalid password hash format")
+
+func newPasswordHasher() PasswordHasher {
+	cfg := config.Env.Password
+	switch cfg.Hasher {
+	case "argon2id":
+		return &argon2idHasher{
+			time:    uint32(cfg.Argon2Time),
+			memory:  uint32(cfg.Argon2Memory),
+			threads: uint8(cfg.Argon2Threads),
+			saltLen: 16,
+			keyLen:  32,
+		}
+	case "bcrypt", "":
+		return &bcryptHasher{cost: cfg.BcryptCost}
+	default:
+		log.Printf("Algoritmo de senha desconhecido %q, usando bcrypt", cfg.Hasher)
+		return &bcryptHasher{cost: cfg.BcryptCost}
+	}
+}
+
+type bcryptHasher struct {
+	cost int
+}
+
+func (b *bcryptHasher) Hash(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), b.cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hashed), nil
+}
+
+func (b *bcryptHasher) Compare(hashed_password, password string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(hashed_password), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (b *bcryptHasher) NeedsRehash(hashed_password string) bool {
+	if !isBcryptHash(hashed_password) {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(hashed_password))
+	return err != nil || cost != b.cost
+}
+
+type argon2idHasher struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+	saltLen int
+	keyLen  uint32
+}
+
+// Hash gera o hash no formato PHC: $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+func (a *argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, a.saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, a.time, a.memory, a.threads, a.keyLen)
+	encoding := base64.RawStdEncoding
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, a.memory, a.time, a.threads,
+		encoding.EncodeToString(salt), encoding.EncodeToString(key),
+	), nil
+}
+
+func (a *argon2idHasher) Compare(hashed_password, password string) (bool, error) {
+	params, salt, key, err := decodeArgon2idHash(hashed_password)
+	if err != nil {
+		return false, err
+	}
+
+	other := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (a *argon2idHasher) NeedsRehash(hashed_password string) bool {
+	params, _, _, err := decodeArgon2idHash(hashed_password)
+	if err != nil {
+		return true
+	}
+	return params.time != a.time || params.memory != a.memory || params.threads != a.threads
+}
+
+func decodeArgon2idHash(hashed_password string) (*argon2idHasher, []byte, []byte, error) {
+	parts := strings.Split(hashed_password, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, nil, nil, errInvalidHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, nil, nil, errInvalidHash
+	}
+
+	params := &argon2idHasher{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil {
+		return nil, nil, nil, errInvalidHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, errInvalidHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, nil, nil, errInvalidHash
+	}
+
+	return params, salt, key, nil
+}
+
+func isBcryptHash(hashed_password string) bool {
+	return strings.HasPrefix(hashed_password, "$2a$") ||
+		strings.HasPrefix(hashed_password, "$2b$") ||
+		strings.HasPrefix(hashed_password, "$2y$")
+}
+
+func isArgon2idHash(hashed_password string) bool {
+	return strings.HasPrefix(hashed_password, "$argon2id$")
+}
+
+// comparePassword valida a senha contra qualquer formato já gravado na base:
+// bcrypt, argon2id ou o base64 legado.
+func (h *Handlers) comparePassword(hashed_password, password string) bool {
+	var (
+		match bool
+		err   error
+	)
+
+	switch {
+	case isBcryptHash(hashed_password):
+		match, err = (&bcryptHasher{}).Compare(hashed_password, password)
+	case isArgon2idHash(hashed_password):
+		match, err = (&argon2idHasher{}).Compare(hashed_password, password)
+	default:
+		match = legacyPasswordsMatch(hashed_password, password)
+	}
+
+	if err != nil {
+		log.Println(err.Error())
+		return false
+	}
+	return match
+}
+
+// rehashPasswordIfNeeded troca o hash do usuário quando ele ainda está no
+// formato legado ou com parâmetros desatualizados. Só deve ser chamada depois
+// de uma autenticação bem-sucedida.
+func (h *Handlers) rehashPasswordIfNeeded(user User, password string) {
+	if !h.hasher.NeedsRehash(user.Password) {
+		return
+	}
+
+	hashed_password, err := h.hasher.Hash(password)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+
+	collection := h.database.Collection("Users")
+	filter := bson.D{
+		{Key: "_id", Value: user.ID},
+		{Key: "password", Value: user.Password},
+	}
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "password", Value: hashed_password},
+		{Key: "updated_at", Value: time.Now()},
+	}}}
+	_, err = collection.UpdateOne(h.context, filter, update)
+	if err != nil {
+		log.Println("Não foi possível migrar o hash da senha:", err.Error())
+	}
+}
+
+func legacyPasswordsMatch(hashed_password, password string) bool {
+	password_encoded := base64.StdEncoding.EncodeToString([]byte(password))
+	return subtle.ConstantTimeCompare([]byte(hashed_password), []byte(password_encoded)) == 1
+}
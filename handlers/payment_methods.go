@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	PaymentTypeCash        = "cash"
+	PaymentTypePix         = "pix"
+	PaymentTypeCardMachine = "card_machine"
+	PaymentTypeVoucherVR   = "voucher_vr"
+	PaymentTypeSodexo      = "voucher_sodexo"
+	PaymentTypeAlelo       = "voucher_alelo"
+	PaymentTypeTicket      = "voucher_ticket"
+)
+
+// paymentTypes é o catálogo de formas de pagamento, na ordem em que o app
+// mostra. Parceiros escolhem quais aceitam.
+var paymentTypes = []PaymentMethod{
+	{Type: PaymentTypeCash, Description: "Dinheiro"},
+	{Type: PaymentTypePix, Description: "PIX"},
+	{Type: PaymentTypeCardMachine, Description: "Cartão na entrega (maquininha)"},
+	{Type: PaymentTypeVoucherVR, Description: "Vale-refeição VR"},
+	{Type: PaymentTypeSodexo, Description: "Vale-refeição Sodexo (Pluxee)"},
+	{Type: PaymentTypeAlelo, Description: "Vale-refeição Alelo"},
+	{Type: PaymentTypeTicket, Description: "Vale-refeição Ticket"},
+}
+
+type PaymentMethod struct {
+	Type        string `json:"type"`
+	Description string `json:"description"`
+}
+
+func isPaymentType(payment_type string) bool {
+	for _, method := range paymentTypes {
+		if method.Type == payment_type {
+			return true
+		}
+	}
+	return false
+}
+
+// AcceptedPaymentMethods devolve as formas de pagamento do parceiro. Parceiros
+// que ainda não configuraram nada aceitam todas. PIX fica de fora sem chave
+// cadastrada ou sem provedor para confirmar o pagamento (pix_enabled).
+func (partner *Partner) AcceptedPaymentMethods(pix_enabled bool) []PaymentMethod {
+	methods := make([]PaymentMethod, 0, len(paymentTypes))
+	for _, method := range paymentTypes {
+		if method.Type == PaymentTypePix && (partner.PixKey == "" || !pix_enabled) {
+			continue
+		}
+		if len(partner.PaymentMethods) == 0 || containsString(partner.PaymentMethods, method.Type) {
+			methods = append(methods, method)
+		}
+	}
+	return methods
+}
+
+func (partner *Partner) AcceptsPayment(payment_type string, pix_enabled bool) bool {
+	for _, method := range partner.AcceptedPaymentMethods(pix_enabled) {
+		if method.Type == payment_type {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// PaymentMethodError é uma forma de pagamento que o parceiro não aceita ou um
+// troco inválido; a mensagem vai na resposta 400.
+type PaymentMethodError struct {
+	Message string
+}
+
+func (e *PaymentMethodError) Error() string {
+	return e.Message
+}
+
+// checkOrderPayment valida a forma de pagamento do pedido e, no dinheiro,
+// calcula o troco. change_for vazio ou igual ao total é pagamento sem troco.
+func checkOrderPayment(partner Partner, payment_type string, pix_enabled bool, change_for *Money, total Money) (Money, error) {
+	if !partner.AcceptsPayment(payment_type, pix_enabled) {
+		return 0, &PaymentMethodError{Message: "Forma de pagamento não aceita por esse parceiro"}
+	}
+	if change_for == nil || *change_for == 0 {
+		return 0, nil
+	}
+	if payment_type != PaymentTypeCash {
+		return 0, &PaymentMethodError{Message: "Troco só pode ser informado no pagamento em dinheiro"}
+	}
+	if *change_for < total {
+		return 0, &PaymentMethodError{Message: fmt.Sprintf("O troco precisa ser para um valor a partir de %s", total)}
+	}
+	return change_for.Sub(total), nil
+}
+
+type PartnerPaymentMethodsReqBody struct {
+	PaymentMethods []string `json:"payment_methods"`
+	PixKey         *string  `json:"pix_key"`
+	City           *string  `json:"city"`
+}
+
+// UpdatePartnerPaymentMethods define as formas de pagamento aceitas pelo
+// parceiro e, para o PIX, a chave e a cidade usadas no BR Code.
+func (h *Handlers) UpdatePartnerPaymentMethods(c *gin.Context) {
+	partner_id, err := strconv.Atoi(c.Param("partner_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Formato de id inválido",
+		})
+		return
+	}
+
+	body := PartnerPaymentMethodsReqBody{}
+	if err := c.ShouldBindBodyWithJSON(&body); err != nil || len(body.PaymentMethods) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Informe pelo menos uma forma de pagamento",
+		})
+		return
+	}
+
+	partner, err := h.findPartner(partner_id)
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusNotFound, gin.H{
+			"status_code": http.StatusNotFound,
+			"message":     "Não foi possível encontrar um parceiro com esse id",
+		})
+		return
+	}
+
+	methods := make([]string, 0, len(body.PaymentMethods))
+	for _, payment_type := range body.PaymentMethods {
+		if !isPaymentType(payment_type) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status_code": http.StatusBadRequest,
+				"message":     fmt.Sprintf("Forma de pagamento %q desconhecida", payment_type),
+			})
+			return
+		}
+		if !containsString(methods, payment_type) {
+			methods = append(methods, payment_type)
+		}
+	}
+
+	update_fields := bson.D{
+		{Key: "payment_methods", Value: methods},
+		{Key: "updated_at", Value: time.Now()},
+	}
+	if body.PixKey != nil {
+		partner.PixKey = *body.PixKey
+		update_fields = append(update_fields, bson.E{Key: "pix_key", Value: partner.PixKey})
+	}
+	if body.City != nil {
+		partner.City = *body.City
+		update_fields = append(update_fields, bson.E{Key: "city", Value: partner.City})
+	}
+	if containsString(methods, PaymentTypePix) && (partner.PixKey == "" || partner.City == "") {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Para aceitar PIX informe a chave PIX e a cidade do parceiro",
+		})
+		return
+	}
+
+	collection := h.database.Collection("Partners")
+	_, err = collection.UpdateOne(h.context, bson.D{{Key: "partner_id", Value: partner_id}}, bson.D{{Key: "$set", Value: update_fields}})
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível atualizar as formas de pagamento",
+		})
+		return
+	}
+
+	partner.PaymentMethods = methods
+	c.JSON(http.StatusOK, gin.H{
+		"status_code":     http.StatusOK,
+		"message":         "Formas de pagamento atualizadas com sucesso",
+		"payment_methods": partner.AcceptedPaymentMethods(h.pixEnabled()),
+	})
+}
@@ -0,0 +1,444 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sergingroisman/meal-maker-functions/cmd/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	PaymentPending  = "pending"
+	PaymentPaid     = "paid"
+	PaymentExpired  = "expired"
+	PaymentRefunded = "refunded"
+)
+
+// OrderPayment é o estado do pagamento online do pedido. Nasce pendente e
+// recebe a cobrança quando o cliente pede o código PIX; o webhook do provedor
+// marca como pago, expirado ou estornado.
+type OrderPayment struct {
+	Status     string     `bson:"status" json:"status"`
+	Amount     Money      `bson:"amount" json:"amount"`
+	Provider   string     `bson:"provider,omitempty" json:"provider,omitempty"`
+	ChargeID   string     `bson:"charge_id,omitempty" json:"charge_id,omitempty"`
+	TxID       string     `bson:"txid,omitempty" json:"txid,omitempty"`
+	BRCode     string     `bson:"br_code,omitempty" json:"br_code,omitempty"`
+	ExpiresAt  *time.Time `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+	PaidAt     *time.Time `bson:"paid_at,omitempty" json:"paid_at,omitempty"`
+	RefundedAt *time.Time `bson:"refunded_at,omitempty" json:"refunded_at,omitempty"`
+	UpdatedAt  time.Time  `bson:"updated_at" json:"updated_at"`
+}
+
+// newOrderPayment devolve o pagamento inicial do pedido, ou nil quando a
+// forma de pagamento não é online.
+func newOrderPayment(payment_type string, total Money, now time.Time) *OrderPayment {
+	if payment_type != PaymentTypePix {
+		return nil
+	}
+	return &OrderPayment{Status: PaymentPending, Amount: total, UpdatedAt: now}
+}
+
+// PixChargeRequest é a cobrança PIX de um pedido a ser criada no provedor.
+type PixChargeRequest struct {
+	OrderID   int
+	Payload   PixPayload
+	ExpiresAt time.Time
+}
+
+// PixCharge é a cobrança criada no provedor. BRCode vem preenchido quando o
+// provedor gera um código dinâmico; vazio, vale o código estático do pedido.
+type PixCharge struct {
+	ChargeID  string
+	BRCode    string
+	ExpiresAt time.Time
+}
+
+// PaymentNotification é a confirmação, já validada, recebida no webhook.
+type PaymentNotification struct {
+	ChargeID string
+	Status   string
+	At       time.Time
+}
+
+var errInvalidWebhook = errors.New("webhook de pagamento inválido")
+
+// PaymentProvider cria as cobranças PIX dinâmicas e interpreta os webhooks do
+// PSP. Novos provedores só precisam implementar essa interface e ser
+// registrados em newPaymentProvider.
+type PaymentProvider interface {
+	Name() string
+	CreatePixCharge(ctx context.Context, request PixChargeRequest) (*PixCharge, error)
+	// ParseWebhook valida a assinatura da notificação e retorna
+	// errInvalidWebhook quando ela não confere.
+	ParseWebhook(header http.Header, body []byte) (*PaymentNotification, error)
+}
+
+// newPaymentProvider devolve nil quando não há provedor configurado; nesse caso
+// o PIX não é oferecido e as rotas de cobrança respondem 503.
+func newPaymentProvider() (PaymentProvider, error) {
+	switch config.Env.Payment.Provider {
+	case "":
+		return nil, nil
+	case "fake":
+		// Qualquer um com o segredo marca pedidos como pagos
+		if !config.IsDevelopment() {
+			log.Println("PAYMENT_PROVIDER=fake só vale em desenvolvimento, pagamento PIX desativado")
+			return nil, nil
+		}
+		if config.Env.Payment.WebhookSecret == "" {
+			return nil, errors.New("PAYMENT_WEBHOOK_SECRET é obrigatório para o provedor de pagamento fake")
+		}
+		return &fakePaymentProvider{secret: config.Env.Payment.WebhookSecret}, nil
+	default:
+		return nil, fmt.Errorf("provedor de pagamento desconhecido %q", config.Env.Payment.Provider)
+	}
+}
+
+// pixEnabled diz se há um provedor para confirmar pagamentos PIX.
+func (h *Handlers) pixEnabled() bool {
+	return h.payments != nil
+}
+
+// paymentsAvailable responde 503 nas rotas que dependem do provedor de
+// pagamento quando não há nenhum configurado.
+func (h *Handlers) paymentsAvailable(c *gin.Context) bool {
+	if h.pixEnabled() {
+		return true
+	}
+	c.JSON(http.StatusServiceUnavailable, gin.H{
+		"status_code": http.StatusServiceUnavailable,
+		"message":     "Pagamento PIX indisponível no momento",
+	})
+	return false
+}
+
+// fakePaymentProvider não fala com nenhum PSP: a cobrança usa o BR Code
+// estático com a chave do parceiro e os webhooks {"charge_id", "status"} são
+// assinados com HMAC-SHA256 do corpo no header X-Webhook-Signature. Usado em
+// desenvolvimento.
+type fakePaymentProvider struct {
+	secret string
+}
+
+func (p *fakePaymentProvider) Name() string {
+	return "fake"
+}
+
+func (p *fakePaymentProvider) CreatePixCharge(ctx context.Context, request PixChargeRequest) (*PixCharge, error) {
+	return &PixCharge{
+		ChargeID:  "fake_" + request.Payload.TxID,
+		ExpiresAt: request.ExpiresAt,
+	}, nil
+}
+
+func (p *fakePaymentProvider) ParseWebhook(header http.Header, body []byte) (*PaymentNotification, error) {
+	mac := hmac.New(sha256.New, []byte(p.secret))
+	mac.Write(body)
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(header.Get("X-Webhook-Signature")), []byte(expected)) {
+		return nil, errInvalidWebhook
+	}
+
+	var notification struct {
+		ChargeID string `json:"charge_id"`
+		Status   string `json:"status"`
+	}
+	if err := json.Unmarshal(body, &notification); err != nil {
+		return nil, errInvalidWebhook
+	}
+	switch notification.Status {
+	case PaymentPaid, PaymentExpired, PaymentRefunded:
+	default:
+		return nil, errInvalidWebhook
+	}
+	return &PaymentNotification{ChargeID: notification.ChargeID, Status: notification.Status, At: time.Now()}, nil
+}
+
+// newPixTxID gera o identificador da transação: alfanumérico e com no máximo
+// 25 caracteres, o limite do BR Code estático.
+func newPixTxID(order_id int) string {
+	txid := "MM" + strconv.Itoa(order_id) + strings.ReplaceAll(uuid.NewString(), "-", "")
+	return txid[:25]
+}
+
+// CreateOrderPixCharge gera o PIX copia e cola e o QR code do total do
+// pedido. Uma cobrança pendente e ainda válida é reaproveitada.
+func (h *Handlers) CreateOrderPixCharge(c *gin.Context) {
+	if !h.paymentsAvailable(c) {
+		return
+	}
+
+	order_id, err := strconv.Atoi(c.Param("order_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Formato de ID inválido",
+		})
+		return
+	}
+
+	order, ok := h.findScopedOrder(c, order_id)
+	if !ok {
+		return
+	}
+	if order.PaymentType != PaymentTypePix || order.Payment == nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Esse pedido não é pago com PIX",
+		})
+		return
+	}
+	if order.Status == OrderCancelled || order.Status == OrderRejected {
+		c.JSON(http.StatusConflict, gin.H{
+			"status_code": http.StatusConflict,
+			"message":     "Pedido cancelado ou recusado não pode ser pago",
+		})
+		return
+	}
+
+	now := time.Now()
+	payment := order.Payment
+	switch {
+	case payment.Status == PaymentPaid || payment.Status == PaymentRefunded:
+		c.JSON(http.StatusConflict, gin.H{
+			"status_code": http.StatusConflict,
+			"message":     "Esse pedido já foi pago",
+		})
+		return
+	case payment.Status == PaymentPending && payment.BRCode != "" && payment.ExpiresAt != nil && payment.ExpiresAt.After(now):
+		respondPixCharge(c, *payment)
+		return
+	}
+
+	partner, err := h.findPartner(order.PartnerID)
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível carregar o parceiro",
+		})
+		return
+	}
+	if partner.PixKey == "" {
+		c.JSON(http.StatusConflict, gin.H{
+			"status_code": http.StatusConflict,
+			"message":     "O parceiro não tem chave PIX cadastrada",
+		})
+		return
+	}
+
+	request := PixChargeRequest{
+		OrderID: order.ID,
+		Payload: PixPayload{
+			Key:          partner.PixKey,
+			MerchantName: partner.Name,
+			MerchantCity: partner.City,
+			Amount:       order.Total,
+			TxID:         newPixTxID(order.ID),
+		},
+		ExpiresAt: now.Add(config.Env.Payment.ChargeTTL),
+	}
+	charge, err := h.payments.CreatePixCharge(h.context, request)
+	if err != nil {
+		log.Println("Erro ao criar cobrança PIX:", err.Error())
+		c.JSON(http.StatusBadGateway, gin.H{
+			"status_code": http.StatusBadGateway,
+			"message":     "Não foi possível gerar o PIX, tente novamente",
+		})
+		return
+	}
+	br_code := charge.BRCode
+	if br_code == "" {
+		br_code = request.Payload.BRCode()
+	}
+
+	updated := OrderPayment{
+		Status:    PaymentPending,
+		Amount:    order.Total,
+		Provider:  h.payments.Name(),
+		ChargeID:  charge.ChargeID,
+		TxID:      request.Payload.TxID,
+		BRCode:    br_code,
+		ExpiresAt: &charge.ExpiresAt,
+		UpdatedAt: now,
+	}
+	collection := h.database.Collection("Orders")
+	// Não sobrescreve um pagamento confirmado enquanto a cobrança era criada
+	filter := bson.D{
+		{Key: "_id", Value: order.ID},
+		{Key: "payment.status", Value: bson.D{{Key: "$in", Value: bson.A{PaymentPending, PaymentExpired}}}},
+	}
+	result, err := collection.UpdateOne(h.context, filter, bson.D{{Key: "$set", Value: bson.D{
+		{Key: "payment", Value: updated},
+		{Key: "updated_at", Value: now},
+	}}})
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível salvar a cobrança PIX",
+		})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusConflict, gin.H{
+			"status_code": http.StatusConflict,
+			"message":     "Esse pedido já foi pago",
+		})
+		return
+	}
+
+	respondPixCharge(c, updated)
+}
+
+func respondPixCharge(c *gin.Context, payment OrderPayment) {
+	png, err := pixQRCodePNG(payment.BRCode)
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível gerar o QR code",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status_code": http.StatusOK,
+		"payment":     payment,
+		"qr_code":     "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+	})
+}
+
+// GetOrderPixQRCode devolve a imagem PNG do QR code da cobrança atual.
+func (h *Handlers) GetOrderPixQRCode(c *gin.Context) {
+	order_id, err := strconv.Atoi(c.Param("order_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Formato de ID inválido",
+		})
+		return
+	}
+
+	order, ok := h.findScopedOrder(c, order_id)
+	if !ok {
+		return
+	}
+	if order.Payment == nil || order.Payment.BRCode == "" {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status_code": http.StatusNotFound,
+			"message":     "Esse pedido não tem cobrança PIX",
+		})
+		return
+	}
+
+	png, err := pixQRCodePNG(order.Payment.BRCode)
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível gerar o QR code",
+		})
+		return
+	}
+	c.Data(http.StatusOK, "image/png", png)
+}
+
+// paymentTransitions são os estados de onde cada notificação pode partir. Um
+// PIX pago depois de expirado continua valendo, o dinheiro entrou.
+var paymentTransitions = map[string][]string{
+	PaymentPaid:     {PaymentPending, PaymentExpired},
+	PaymentExpired:  {PaymentPending},
+	PaymentRefunded: {PaymentPaid},
+}
+
+// PaymentWebhook recebe as notificações do provedor de pagamento. Notificações
+// repetidas ou fora de ordem são aceitas sem alterar o pedido, para o
+// provedor não ficar reenviando.
+func (h *Handlers) PaymentWebhook(c *gin.Context) {
+	if !h.paymentsAvailable(c) {
+		return
+	}
+
+	body, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Notificação inválida",
+		})
+		return
+	}
+
+	notification, err := h.payments.ParseWebhook(c.Request.Header, body)
+	if err != nil {
+		if !errors.Is(err, errInvalidWebhook) {
+			log.Println(err.Error())
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"status_code": http.StatusUnauthorized,
+			"message":     "Notificação inválida",
+		})
+		return
+	}
+
+	set := bson.D{
+		{Key: "payment.status", Value: notification.Status},
+		{Key: "payment.updated_at", Value: notification.At},
+		{Key: "updated_at", Value: notification.At},
+	}
+	switch notification.Status {
+	case PaymentPaid:
+		set = append(set, bson.E{Key: "payment.paid_at", Value: notification.At})
+	case PaymentRefunded:
+		set = append(set, bson.E{Key: "payment.refunded_at", Value: notification.At})
+	}
+
+	collection := h.database.Collection("Orders")
+	filter := bson.D{
+		{Key: "payment.charge_id", Value: notification.ChargeID},
+		{Key: "payment.status", Value: bson.D{{Key: "$in", Value: paymentTransitions[notification.Status]}}},
+	}
+	result, err := collection.UpdateOne(h.context, filter, bson.D{{Key: "$set", Value: set}})
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível registrar o pagamento",
+		})
+		return
+	}
+
+	if result.MatchedCount == 0 {
+		err := collection.FindOne(h.context, bson.D{{Key: "payment.charge_id", Value: notification.ChargeID}}).Err()
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"status_code": http.StatusNotFound,
+				"message":     "Cobrança não encontrada",
+			})
+			return
+		}
+		if err != nil {
+			log.Println(err.Error())
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status_code": http.StatusOK,
+		"message":     "Notificação recebida",
+	})
+}
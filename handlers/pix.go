@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// PixPayload são os dados do BR Code (PIX copia e cola). Com Key o código é
+// estático, montado aqui com a chave do parceiro; com URL é dinâmico e aponta
+// para a cobrança criada no provedor de pagamento.
+type PixPayload struct {
+	Key          string
+	URL          string
+	MerchantName string
+	MerchantCity string
+	Amount       Money
+	TxID         string
+}
+
+// BRCode monta o payload EMV do PIX conforme o manual do BR Code do Banco
+// Central: campos ID+tamanho+valor e o CRC16 no final.
+func (p PixPayload) BRCode() string {
+	account := emvField("00", "br.gov.bcb.pix")
+	if p.URL != "" {
+		account += emvField("25", p.URL)
+	} else {
+		account += emvField("01", p.Key)
+	}
+
+	txid := p.TxID
+	if txid == "" {
+		txid = "***"
+	}
+
+	var payload strings.Builder
+	payload.WriteString(emvField("00", "01"))
+	// 12: o código vale para um único pagamento
+	payload.WriteString(emvField("01", "12"))
+	payload.WriteString(emvField("26", account))
+	payload.WriteString(emvField("52", "0000"))
+	payload.WriteString(emvField("53", "986"))
+	if p.Amount > 0 {
+		payload.WriteString(emvField("54", fmt.Sprintf("%d.%02d", p.Amount/100, p.Amount%100)))
+	}
+	payload.WriteString(emvField("58", "BR"))
+	payload.WriteString(emvField("59", emvText(p.MerchantName, 25)))
+	payload.WriteString(emvField("60", emvText(p.MerchantCity, 15)))
+	payload.WriteString(emvField("62", emvField("05", txid)))
+	payload.WriteString("6304")
+
+	code := payload.String()
+	return code + fmt.Sprintf("%04X", crc16CCITT([]byte(code)))
+}
+
+// pixQRCodePNG gera a imagem do QR code de um BR Code.
+func pixQRCodePNG(br_code string) ([]byte, error) {
+	return qrcode.Encode(br_code, qrcode.Medium, 320)
+}
+
+func emvField(id string, value string) string {
+	return fmt.Sprintf("%s%02d%s", id, len(value), value)
+}
+
+var emvAccents = strings.NewReplacer(
+	"á", "a", "à", "a", "â", "a", "ã", "a", "ä", "a",
+	"é", "e", "è", "e", "ê", "e", "ë", "e",
+	"í", "i", "ì", "i", "î", "i", "ï", "i",
+	"ó", "o", "ò", "o", "ô", "o", "õ", "o", "ö", "o",
+	"ú", "u", "ù", "u", "û", "u", "ü", "u",
+	"ç", "c", "ñ", "n",
+	"Á", "A", "À", "A", "Â", "A", "Ã", "A", "Ä", "A",
+	"É", "E", "È", "E", "Ê", "E", "Ë", "E",
+	"Í", "I", "Ì", "I", "Î", "I", "Ï", "I",
+	"Ó", "O", "Ò", "O", "Ô", "O", "Õ", "O", "Ö", "O",
+	"Ú", "U", "Ù", "U", "Û", "U", "Ü", "U",
+	"Ç", "C", "Ñ", "N",
+)
+
+// emvText deixa o nome e a cidade em ASCII, sem acentos, e corta no tamanho
+// máximo do campo. Alguns bancos recusam o código com caracteres acentuados.
+func emvText(value string, max int) string {
+	value = emvAccents.Replace(value)
+	value = strings.Map(func(r rune) rune {
+		if r > unicode.MaxASCII || !unicode.IsPrint(r) {
+			return -1
+		}
+		return r
+	}, value)
+	value = strings.TrimSpace(value)
+	if len(value) > max {
+		value = strings.TrimSpace(value[:max])
+	}
+	return value
+}
+
+// crc16CCITT é o CRC16-CCITT-FALSE (polinômio 0x1021, inicial 0xFFFF) usado no
+// campo 63 do BR Code.
+func crc16CCITT(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
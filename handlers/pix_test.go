@@ -0,0 +1,51 @@
+package handlers
+
+import "testing"
+
+// Exemplo de BR Code estático do manual do Banco Central.
+const bcbReferencePayload = "00020126580014br.gov.bcb.pix0136123e4567-e12b-12d1-a456-4266554400005204000053039865802BR5913Fulano de Tal6008BRASILIA62070503***6304"
+
+func TestCRC16CCITT(t *testing.T) {
+	if crc := crc16CCITT([]byte(bcbReferencePayload)); crc != 0x1D3D {
+		t.Fatalf("crc16CCITT = %04X, esperava 1D3D", crc)
+	}
+}
+
+func TestPixPayloadBRCode(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload PixPayload
+		want    string
+	}{
+		{
+			// O exemplo do manual com o campo 01 (pagamento único), que o
+			// BRCode sempre inclui
+			name: "exemplo do manual",
+			payload: PixPayload{
+				Key:          "123e4567-e12b-12d1-a456-426655440000",
+				MerchantName: "Fulano de Tal",
+				MerchantCity: "BRASILIA",
+			},
+			want: "00020101021226580014br.gov.bcb.pix0136123e4567-e12b-12d1-a456-4266554400005204000053039865802BR5913Fulano de Tal6008BRASILIA62070503***6304EF53",
+		},
+		{
+			name: "valor, txid e nomes com acento",
+			payload: PixPayload{
+				Key:          "123e4567-e12b-12d1-a456-426655440000",
+				MerchantName: "Padaria São João",
+				MerchantCity: "São Paulo",
+				Amount:       1050,
+				TxID:         "MM42",
+			},
+			want: "00020101021226580014br.gov.bcb.pix0136123e4567-e12b-12d1-a456-426655440000520400005303986540510.505802BR5916Padaria Sao Joao6009Sao Paulo62080504MM4263044BC9",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.payload.BRCode(); got != tt.want {
+				t.Errorf("BRCode() =\n%s\nesperava\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const DeliveryTypePickup = "pickup"
+
+// OrderPricingError é um problema no carrinho que o cliente consegue corrigir
+// (prato inexistente, inativo, acompanhamentos demais). A mensagem vai direto
+// para a resposta.
+type OrderPricingError struct {
+	Message string
+}
+
+func (e *OrderPricingError) Error() string {
+	return e.Message
+}
+
+const (
+	DiscountSourceDish   = "dish"
+	DiscountSourceCoupon = "coupon"
+)
+
+// OrderDiscount é uma linha do detalhamento de descontos do pedido: a promoção
+// de um prato ou o cupom aplicado.
+type OrderDiscount struct {
+	Source      string              `bson:"source" json:"source"`
+	Description string              `bson:"description" json:"description"`
+	DishID      string              `bson:"dish_id,omitempty" json:"dish_id,omitempty"`
+	CouponID    *primitive.ObjectID `bson:"coupon_id,omitempty" json:"coupon_id,omitempty"`
+	CouponCode  string              `bson:"coupon_code,omitempty" json:"coupon_code,omitempty"`
+	Amount      Money               `bson:"amount" json:"amount"`
+}
+
+// OrderPricing é o carrinho recalculado a partir do cadastro de pratos e do
+// parceiro. Nenhum preço enviado pelo app é aproveitado.
+type OrderPricing struct {
+	Partner       Partner
+	Dishes        []OrderDishes
+	QuantityTotal int
+	Subtotal      Money
+	Discounts     []OrderDiscount
+	Discount      Money
+	DeliveryFee   Money
+	Total         Money
+}
+
+// addDiscount inclui o desconto no detalhamento e recalcula o total.
+func (p *OrderPricing) addDiscount(discount OrderDiscount) {
+	p.Discounts = append(p.Discounts, discount)
+	p.Discount = p.Discount.Add(discount.Amount)
+	p.Total = p.Subtotal.Sub(p.Discount).Add(p.DeliveryFee)
+}
+
+// priceOrder resolve os pratos e acompanhamentos do pedido e recalcula os
+// valores. Erros do tipo *OrderPricingError devem ser devolvidos como 400.
+func (h *Handlers) priceOrder(partner_id int, delivery_type string, items []OrderDishes) (*OrderPricing, error) {
+	if len(items) == 0 {
+		return nil, &OrderPricingError{Message: "O pedido precisa ter pelo menos um prato"}
+	}
+
+	partner, err := h.findPartner(partner_id)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, &OrderPricingError{Message: "Parceiro não encontrado"}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	dish_ids := make([]primitive.ObjectID, 0, len(items))
+	accompaniment_ids := make([]primitive.ObjectID, 0)
+	for _, item := range items {
+		id, err := primitive.ObjectIDFromHex(item.ID)
+		if err != nil {
+			return nil, &OrderPricingError{Message: fmt.Sprintf("Prato %q não encontrado", item.ID)}
+		}
+		dish_ids = append(dish_ids, id)
+		for _, accompaniment := range item.Accompaniments {
+			accompaniment_ids = append(accompaniment_ids, accompaniment.ID)
+		}
+	}
+
+	dishes, err := h.findDishesByID(dish_ids)
+	if err != nil {
+		return nil, err
+	}
+	accompaniments, err := h.findAccompanimentsByID(accompaniment_ids)
+	if err != nil {
+		return nil, err
+	}
+
+	pricing := &OrderPricing{Partner: partner, Dishes: make([]OrderDishes, 0, len(items)), Discounts: make([]OrderDiscount, 0)}
+	dish_discounts := make([]OrderDiscount, 0)
+	for i, item := range items {
+		dish, exists := dishes[dish_ids[i]]
+		if !exists {
+			return nil, &OrderPricingError{Message: fmt.Sprintf("Prato %q não encontrado", item.ID)}
+		}
+		if !dish.Active {
+			return nil, &OrderPricingError{Message: fmt.Sprintf("O prato %s não está disponível no momento", dish.Title)}
+		}
+		if item.Quantity < 1 {
+			return nil, &OrderPricingError{Message: fmt.Sprintf("Quantidade inválida para o prato %s", dish.Title)}
+		}
+		if dish.MaxAccompanimentsCount > 0 && len(item.Accompaniments) > dish.MaxAccompanimentsCount {
+			return nil, &OrderPricingError{Message: fmt.Sprintf("O prato %s aceita no máximo %d acompanhamentos", dish.Title, dish.MaxAccompanimentsCount)}
+		}
+
+		line_accompaniments := make([]Accompaniment, 0, len(item.Accompaniments))
+		for _, requested := range item.Accompaniments {
+			accompaniment, exists := accompaniments[requested.ID]
+			if !exists {
+				return nil, &OrderPricingError{Message: fmt.Sprintf("Acompanhamento %q não encontrado", requested.ID.Hex())}
+			}
+			line_accompaniments = append(line_accompaniments, accompaniment)
+		}
+
+		line_total := dish.Price.Mul(item.Quantity)
+		pricing.Dishes = append(pricing.Dishes, OrderDishes{
+			ID:             dish.ID.Hex(),
+			Title:          dish.Title,
+			Price:          dish.Price,
+			LineTotal:      line_total,
+			Observation:    item.Observation,
+			Quantity:       item.Quantity,
+			Accompaniments: line_accompaniments,
+		})
+		pricing.QuantityTotal += item.Quantity
+		pricing.Subtotal = pricing.Subtotal.Add(line_total)
+
+		// O desconto do prato é um valor em reais por unidade
+		if dish.Discount > 0 {
+			dish_discounts = append(dish_discounts, OrderDiscount{
+				Source:      DiscountSourceDish,
+				Description: "Promoção " + dish.Title,
+				DishID:      dish.ID.Hex(),
+				Amount:      dish.Discount.Min(dish.Price).Mul(item.Quantity),
+			})
+		}
+	}
+
+	if delivery_type != DeliveryTypePickup {
+		pricing.DeliveryFee = partner.DeliveryFee
+	}
+	pricing.Total = pricing.Subtotal.Add(pricing.DeliveryFee)
+	for _, discount := range dish_discounts {
+		pricing.addDiscount(discount)
+	}
+
+	return pricing, nil
+}
+
+func (h *Handlers) findDishesByID(ids []primitive.ObjectID) (map[primitive.ObjectID]Dish, error) {
+	dishes := make(map[primitive.ObjectID]Dish, len(ids))
+	collection := h.database.Collection("Dishes")
+	cursor, err := collection.Find(h.context, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(h.context)
+
+	for cursor.Next(h.context) {
+		var dish Dish
+		if err := cursor.Decode(&dish); err != nil {
+			return nil, err
+		}
+		dishes[dish.ID] = dish
+	}
+	return dishes, cursor.Err()
+}
+
+func (h *Handlers) findAccompanimentsByID(ids []primitive.ObjectID) (map[primitive.ObjectID]Accompaniment, error) {
+	accompaniments := make(map[primitive.ObjectID]Accompaniment, len(ids))
+	if len(ids) == 0 {
+		return accompaniments, nil
+	}
+
+	collection := h.database.Collection("Accompaniments")
+	cursor, err := collection.Find(h.context, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(h.context)
+
+	for cursor.Next(h.context) {
+		var accompaniment Accompaniment
+		if err := cursor.Decode(&accompaniment); err != nil {
+			return nil, err
+		}
+		accompaniments[accompaniment.ID] = accompaniment
+	}
+	return accompaniments, cursor.Err()
+}
@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const anonymizedUserName = "Cliente removido"
+
+// UserDataExport é o pacote de dados pessoais entregue ao titular (LGPD, art. 18).
+type UserDataExport struct {
+	User       User          `json:"user"`
+	Addresses  []UserAddress `json:"addresses"`
+	Orders     []Order       `json:"orders"`
+	ExportedAt time.Time     `json:"exported_at"`
+}
+
+type DeleteAccountReqBody struct {
+	Password string `bson:"password" json:"password"`
+}
+
+func (h *Handlers) ExportUserData(c *gin.Context) {
+	user_id, ok := resolveUserID(c)
+	if !ok {
+		return
+	}
+
+	user, err := h.loadAddressBook(user_id)
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusNotFound, gin.H{
+			"status_code": http.StatusNotFound,
+			"message":     "Não foi possível encontrar esse usuário",
+		})
+		return
+	}
+
+	collection := h.database.Collection("Orders")
+	filter := bson.D{{Key: "user._id", Value: user_id}}
+	options := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	cursor, err := collection.Find(h.context, filter, options)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, err)
+		return
+	}
+	defer cursor.Close(h.context)
+
+	orders := make([]Order, 0)
+	for cursor.Next(h.context) {
+		var order Order
+		if err := cursor.Decode(&order); err != nil {
+			log.Println(err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status_code": http.StatusInternalServerError,
+				"message":     "Não foi possível processar a lista de pedidos",
+			})
+			return
+		}
+		order.User.Password = ""
+		orders = append(orders, order)
+	}
+
+	addresses := user.Addresses
+	if addresses == nil {
+		addresses = make([]UserAddress, 0)
+	}
+	user.Password = ""
+	user.Addresses = nil
+
+	c.Header("Content-Disposition", "attachment; filename=meus-dados.json")
+	c.IndentedJSON(http.StatusOK, UserDataExport{
+		User:       user,
+		Addresses:  addresses,
+		Orders:     orders,
+		ExportedAt: time.Now(),
+	})
+}
+
+// DeleteAccount apaga o cadastro do cliente. Os pedidos não são apagados para
+// não quebrar os relatórios dos parceiros: os dados pessoais copiados neles
+// (nome, telefone e endereço) são anonimizados.
+func (h *Handlers) DeleteAccount(c *gin.Context) {
+	user_id, ok := resolveUserID(c)
+	if !ok {
+		return
+	}
+
+	body := DeleteAccountReqBody{}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindBodyWithJSON(&body); err != nil {
+			log.Println(err.Error())
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status_code": http.StatusBadRequest,
+				"message":     "Não foi possível processar a exclusão da conta",
+			})
+			return
+		}
+	}
+
+	var user User
+	collectionU := h.database.Collection("Users")
+	err := collectionU.FindOne(h.context, bson.D{{Key: "_id", Value: user_id}}).Decode(&user)
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusNotFound, gin.H{
+			"status_code": http.StatusNotFound,
+			"message":     "Não foi possível encontrar esse usuário",
+		})
+		return
+	}
+
+	// O próprio titular confirma com a senha; admins atendem pedidos feitos
+	// por outros canais
+	if auth_user := getAuthUser(c); !auth_user.IsAdmin() {
+		if !h.checkAuthLockout(c, user.PhoneNumber) {
+			return
+		}
+		if !h.comparePassword(user.Password, body.Password) {
+			h.registerAuthFailure(c, user.PhoneNumber)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status_code": http.StatusBadRequest,
+				"message":     "Senha inválida",
+			})
+			return
+		}
+	}
+
+	err = h.anonymizeUserOrders(user.ID)
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível anonimizar os pedidos do usuário",
+		})
+		return
+	}
+
+	h.deleteUserAuthData(user)
+
+	_, err = collectionU.DeleteOne(h.context, bson.D{{Key: "_id", Value: user.ID}})
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível deletar o usuário",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status_code": http.StatusOK,
+		"message":     "Conta deletada com sucesso",
+	})
+}
+
+// anonymizeUserOrders troca os dados pessoais embutidos nos pedidos por
+// valores neutros. O _id do usuário vira um id aleatório, o que mantém a
+// contagem de clientes distintos nos relatórios sem permitir reidentificação.
+// Cidade e estado são mantidos por não identificarem o titular.
+func (h *Handlers) anonymizeUserOrders(user_id primitive.ObjectID) error {
+	collection := h.database.Collection("Orders")
+	pseudonymous_id := primitive.NewObjectID()
+	filter := bson.D{{Key: "user._id", Value: user_id}}
+	update := bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: "user._id", Value: pseudonymous_id},
+			{Key: "user.name", Value: anonymizedUserName},
+			{Key: "user.phone_number", Value: ""},
+			{Key: "user.password", Value: ""},
+			{Key: "user.address.street", Value: ""},
+			{Key: "user.address.number", Value: ""},
+			{Key: "user.address.cep", Value: ""},
+			{Key: "user.address.complement", Value: ""},
+			{Key: "user.anonymized_at", Value: time.Now()},
+		}},
+		{Key: "$unset", Value: bson.D{
+			{Key: "user.addresses", Value: ""},
+			{Key: "delivery_address.street", Value: ""},
+			{Key: "delivery_address.number", Value: ""},
+			{Key: "delivery_address.cep", Value: ""},
+			{Key: "delivery_address.complement", Value: ""},
+			{Key: "delivery_address.reference", Value: ""},
+			// Texto livre, pode ter dados pessoais
+			{Key: "cancellation.reason", Value: ""},
+		}},
+	}
+
+	// O histórico de status registra o id do cliente nas ações dele. Só
+	// pedidos que têm histórico entram, já que $[] exige o array existente.
+	history_filter := bson.D{
+		{Key: "user._id", Value: user_id},
+		{Key: "status_history.actor_id", Value: user_id.Hex()},
+	}
+	history_update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "status_history.$[customer].actor_id", Value: pseudonymous_id.Hex()},
+	}}}
+	opts := options.Update().SetArrayFilters(options.ArrayFilters{
+		Filters: []interface{}{bson.D{{Key: "customer.actor_id", Value: user_id.Hex()}}},
+	})
+	_, err := collection.UpdateMany(h.context, history_filter, history_update, opts)
+	if err != nil {
+		return err
+	}
+
+	// O cancelamento feito pelo cliente também guarda o id dele
+	cancellation_filter := bson.D{
+		{Key: "user._id", Value: user_id},
+		{Key: "cancellation.actor_id", Value: user_id.Hex()},
+	}
+	cancellation_update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "cancellation.actor_id", Value: pseudonymous_id.Hex()},
+	}}}
+	_, err = collection.UpdateMany(h.context, cancellation_filter, cancellation_update)
+	if err != nil {
+		return err
+	}
+
+	_, err = collection.UpdateMany(h.context, filter, update)
+	return err
+}
+
+// deleteUserAuthData remove sessões, códigos, pedidos de reset e os eventos de
+// segurança com o telefone do usuário. Falhas aqui só são logadas; com exceção
+// dos eventos de segurança, esses documentos também expiram por TTL.
+func (h *Handlers) deleteUserAuthData(user User) {
+	deletes := []struct {
+		collection string
+		filter     bson.D
+	}{
+		{"Sessions", bson.D{{Key: "user_id", Value: user.ID}}},
+		{"PasswordResets", bson.D{{Key: "user_id", Value: user.ID}}},
+		{"OneTimeCodes", bson.D{{Key: "phone_number", Value: user.PhoneNumber}}},
+		{"AuthAttempts", bson.D{{Key: "_id", Value: "phone:" + user.PhoneNumber}}},
+		{"SecurityEvents", bson.D{{Key: "phone_number", Value: user.PhoneNumber}}},
+	}
+
+	for _, d := range deletes {
+		_, err := h.database.Collection(d.collection).DeleteMany(h.context, d.filter)
+		if err != nil {
+			log.Printf("Não foi possível limpar %s do usuário %s: %s", d.collection, user.ID.Hex(), err.Error())
+		}
+	}
+}
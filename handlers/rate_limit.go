@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sergingroisman/meal-maker-functions/cmd/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AuthAttempt guarda as falhas de autenticação de um telefone ou IP. Fica no
+// Mongo para ser compartilhado entre as instâncias do Azure Functions.
+type AuthAttempt struct {
+	ID            string     `bson:"_id" json:"_id"`
+	Failures      int        `bson:"failures" json:"failures"`
+	Lockouts      int        `bson:"lockouts" json:"lockouts"`
+	LockedUntil   *time.Time `bson:"locked_until,omitempty" json:"locked_until,omitempty"`
+	LastFailureAt time.Time  `bson:"last_failure_at" json:"last_failure_at"`
+	ExpiresAt     time.Time  `bson:"expires_at" json:"expires_at"`
+}
+
+type SecurityEvent struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	Type        string             `bson:"type" json:"type"`
+	Key         string             `bson:"key" json:"key"`
+	PhoneNumber string             `bson:"phone_number" json:"phone_number"`
+	IP          string             `bson:"ip" json:"ip"`
+	Route       string             `bson:"route" json:"route"`
+	Failures    int                `bson:"failures" json:"failures"`
+	LockedUntil time.Time          `bson:"locked_until" json:"locked_until"`
+	CreatedAt   time.Time          `bson:"created_at" json:"created_at"`
+}
+
+const securityEventLockout = "auth_lockout"
+
+func authAttemptKeys(c *gin.Context, phone_number string) []string {
+	keys := []string{"ip:" + c.ClientIP()}
+	if phone_number != "" {
+		keys = append(keys, "phone:"+phone_number)
+	}
+	return keys
+}
+
+// checkAuthLockout responde 429 com Retry-After e retorna false quando o
+// telefone ou o IP estão bloqueados.
+func (h *Handlers) checkAuthLockout(c *gin.Context, phone_number string) bool {
+	collection := h.database.Collection("AuthAttempts")
+	filter := bson.D{
+		{Key: "_id", Value: bson.D{{Key: "$in", Value: authAttemptKeys(c, phone_number)}}},
+		{Key: "locked_until", Value: bson.D{{Key: "$gt", Value: time.Now()}}},
+	}
+	opts := options.FindOne().SetSort(bson.D{{Key: "locked_until", Value: -1}})
+
+	var attempt AuthAttempt
+	err := collection.FindOne(h.context, filter, opts).Decode(&attempt)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return true
+	}
+	if err != nil {
+		// Falha ao consultar o bloqueio não deve derrubar o login
+		log.Println(err.Error())
+		return true
+	}
+
+	retry_after := int(math.Ceil(time.Until(*attempt.LockedUntil).Seconds()))
+	c.Header("Retry-After", strconv.Itoa(retry_after))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"status_code": http.StatusTooManyRequests,
+		"message":     "Muitas tentativas de acesso, tente novamente mais tarde",
+		"retry_after": retry_after,
+	})
+	return false
+}
+
+// registerAuthFailure conta uma falha para o telefone e para o IP. Ao atingir
+// o limite, a chave é bloqueada por um tempo que dobra a cada novo bloqueio.
+func (h *Handlers) registerAuthFailure(c *gin.Context, phone_number string) {
+	cfg := config.Env.RateLimit
+	collection := h.database.Collection("AuthAttempts")
+
+	for _, key := range authAttemptKeys(c, phone_number) {
+		max_attempts := cfg.PhoneMaxAttempts
+		if strings.HasPrefix(key, "ip:") {
+			max_attempts = cfg.IPMaxAttempts
+		}
+
+		var attempt AuthAttempt
+		update := bson.D{
+			{Key: "$inc", Value: bson.D{{Key: "failures", Value: 1}}},
+			{Key: "$set", Value: bson.D{{Key: "last_failure_at", Value: time.Now()}}},
+			{Key: "$max", Value: bson.D{{Key: "expires_at", Value: time.Now().Add(cfg.Window)}}},
+		}
+		opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+		err := collection.FindOneAndUpdate(h.context, bson.D{{Key: "_id", Value: key}}, update, opts).Decode(&attempt)
+		if err != nil {
+			log.Println(err.Error())
+			continue
+		}
+
+		if attempt.Failures < max_attempts {
+			continue
+		}
+
+		locked_until := time.Now().Add(lockoutDuration(attempt.Lockouts))
+		lock_filter := bson.D{
+			{Key: "_id", Value: key},
+			{Key: "failures", Value: bson.D{{Key: "$gte", Value: max_attempts}}},
+		}
+		lock_update := bson.D{
+			{Key: "$set", Value: bson.D{
+				{Key: "failures", Value: 0},
+				{Key: "locked_until", Value: locked_until},
+				{Key: "expires_at", Value: locked_until.Add(cfg.Window)},
+			}},
+			{Key: "$inc", Value: bson.D{{Key: "lockouts", Value: 1}}},
+		}
+		result, err := collection.UpdateOne(h.context, lock_filter, lock_update)
+		if err != nil {
+			log.Println(err.Error())
+			continue
+		}
+		if result.ModifiedCount == 0 {
+			continue
+		}
+
+		h.recordSecurityEvent(SecurityEvent{
+			Type:        securityEventLockout,
+			Key:         key,
+			PhoneNumber: phone_number,
+			IP:          c.ClientIP(),
+			Route:       c.FullPath(),
+			Failures:    attempt.Failures,
+			LockedUntil: locked_until,
+		})
+	}
+}
+
+// clearAuthFailures zera o contador do telefone depois de um acesso válido. O
+// contador do IP continua, já que um atacante pode ter uma conta própria.
+func (h *Handlers) clearAuthFailures(phone_number string) {
+	collection := h.database.Collection("AuthAttempts")
+	filter := bson.D{
+		{Key: "_id", Value: "phone:" + phone_number},
+		{Key: "failures", Value: bson.D{{Key: "$gt", Value: 0}}},
+	}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "failures", Value: 0}}}}
+	if _, err := collection.UpdateOne(h.context, filter, update); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func (h *Handlers) recordSecurityEvent(event SecurityEvent) {
+	event.ID = primitive.NewObjectID()
+	event.CreatedAt = time.Now()
+
+	log.Printf("Evento de segurança %s: %s bloqueado até %s", event.Type, event.Key, event.LockedUntil.Format(time.RFC3339))
+	collection := h.database.Collection("SecurityEvents")
+	if _, err := collection.InsertOne(h.context, event); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func lockoutDuration(previous_lockouts int) time.Duration {
+	cfg := config.Env.RateLimit
+	if previous_lockouts > 16 {
+		return cfg.MaxLockout
+	}
+	duration := cfg.BaseLockout * time.Duration(1<<previous_lockouts)
+	if duration > cfg.MaxLockout {
+		return cfg.MaxLockout
+	}
+	return duration
+}
+
+func (h *Handlers) GetSecurityEvents(c *gin.Context) {
+	collection := h.database.Collection("SecurityEvents")
+
+	filter := bson.D{}
+	if phone_number, exists := c.GetQuery("phone_number"); exists {
+		filter = append(filter, bson.E{Key: "phone_number", Value: phone_number})
+	}
+	if ip, exists := c.GetQuery("ip"); exists {
+		filter = append(filter, bson.E{Key: "ip", Value: ip})
+	}
+
+	options := options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(100)
+	cursor, err := collection.Find(h.context, filter, options)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, err)
+		return
+	}
+	defer cursor.Close(h.context)
+
+	events := make([]SecurityEvent, 0)
+	for cursor.Next(h.context) {
+		var event SecurityEvent
+		if err := cursor.Decode(&event); err != nil {
+			log.Println(err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status_code": http.StatusInternalServerError,
+				"message":     "Não foi possível processar a lista de eventos de segurança",
+			})
+			return
+		}
+		events = append(events, event)
+	}
+
+	c.IndentedJSON(http.StatusOK, events)
+}
@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// OrdersReport resume os pedidos do dia de um parceiro. Pedidos cancelados e
+// recusados ficam fora do faturamento e são contados à parte.
+type OrdersReport struct {
+	PartnerID int                  `json:"partner_id"`
+	Date      string               `json:"date"`
+	Orders    int                  `json:"orders"`
+	Revenue   Money                `json:"revenue"`
+	ByStatus  map[string]int       `json:"by_status"`
+	Cancelled CancelledOrdersCount `json:"cancelled"`
+	Rejected  int                  `json:"rejected"`
+}
+
+type CancelledOrdersCount struct {
+	Total    int            `json:"total"`
+	ByReason map[string]int `json:"by_reason"`
+	ByActor  map[string]int `json:"by_actor"`
+}
+
+func (h *Handlers) GetOrdersReportByPartnerID(c *gin.Context) {
+	partner_id_str := c.Param("partner_id")
+	if partner_id_str == "" {
+		c.IndentedJSON(http.StatusBadRequest, "Necessário passar o id do parceiro como parâmetro")
+		return
+	}
+
+	partner_id, err := strconv.Atoi(partner_id_str)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Formato de id inválido",
+		})
+		return
+	}
+
+	partner, err := h.findPartnerForDay(partner_id)
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível carregar o parceiro",
+		})
+		return
+	}
+
+	start_of_day, end_of_day := partner.DayRange(time.Now())
+	collection := h.database.Collection("Orders")
+	filter := bson.D{
+		{Key: "partner_id", Value: partner_id},
+		{Key: "created_at", Value: bson.D{{Key: "$gte", Value: start_of_day}, {Key: "$lt", Value: end_of_day}}},
+	}
+	projection := bson.D{
+		{Key: "status", Value: 1},
+		{Key: "total", Value: 1},
+		{Key: "cancellation", Value: 1},
+	}
+	cursor, err := collection.Find(h.context, filter, options.Find().SetProjection(projection))
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, err)
+		return
+	}
+	defer cursor.Close(h.context)
+
+	report := OrdersReport{
+		PartnerID: partner_id,
+		Date:      start_of_day.Format("2006-01-02"),
+		ByStatus:  map[string]int{},
+		Cancelled: CancelledOrdersCount{
+			ByReason: map[string]int{},
+			ByActor:  map[string]int{},
+		},
+	}
+	for cursor.Next(h.context) {
+		var order Order
+		if err := cursor.Decode(&order); err != nil {
+			log.Println(err.Error())
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"status_code": http.StatusInternalServerError,
+				"message":     "Não foi possível processar a lista de pedidos",
+			})
+			return
+		}
+
+		switch order.Status {
+		case OrderCancelled:
+			report.Cancelled.Total++
+			if order.Cancellation != nil {
+				report.Cancelled.ByReason[order.Cancellation.ReasonCode]++
+				report.Cancelled.ByActor[order.Cancellation.Actor]++
+			}
+		case OrderRejected:
+			report.Rejected++
+		default:
+			report.Orders++
+			report.Revenue = report.Revenue.Add(order.Total)
+			report.ByStatus[order.Status.String()]++
+		}
+	}
+
+	c.IndentedJSON(http.StatusOK, report)
+}
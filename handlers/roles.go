@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	RoleClient  = "client"
+	RolePartner = "partner"
+	RoleCourier = "courier"
+	RoleAdmin   = "admin"
+)
+
+const (
+	tokenIssuer = "meal-maker-functions"
+	authUserKey = "auth_user"
+)
+
+type AuthClaims struct {
+	PhoneNumber string `json:"phone_number"`
+	Role        string `json:"role"`
+	PartnerID   int    `json:"partner_id"`
+	DeliveryID  int    `json:"delivery_id,omitempty"`
+	SessionID   string `json:"sid"`
+	jwt.RegisteredClaims
+}
+
+type UpdateUserRoleReqBody struct {
+	Role       string `bson:"role" json:"role" validate:"required,oneof=client partner courier admin"`
+	PartnerID  int    `bson:"partner_id" json:"partner_id"`
+	DeliveryID int    `bson:"delivery_id" json:"delivery_id"`
+}
+
+func isValidRole(role string) bool {
+	switch role {
+	case RoleClient, RolePartner, RoleCourier, RoleAdmin:
+		return true
+	}
+	return false
+}
+
+// AuthUser é o usuário autenticado que o AuthenticateMiddleware coloca no
+// contexto do gin a partir das claims do token.
+type AuthUser struct {
+	ID          primitive.ObjectID
+	PhoneNumber string
+	Role        string
+	PartnerID   int
+	DeliveryID  int
+	SessionID   string
+}
+
+func newAuthUser(claims *AuthClaims) (*AuthUser, error) {
+	user_id, err := primitive.ObjectIDFromHex(claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AuthUser{
+		ID:          user_id,
+		PhoneNumber: claims.PhoneNumber,
+		Role:        claims.Role,
+		PartnerID:   claims.PartnerID,
+		DeliveryID:  claims.DeliveryID,
+		SessionID:   claims.SessionID,
+	}, nil
+}
+
+func getAuthUser(c *gin.Context) *AuthUser {
+	value, exists := c.Get(authUserKey)
+	if !exists {
+		return nil
+	}
+	auth_user, _ := value.(*AuthUser)
+	return auth_user
+}
+
+func (u *AuthUser) IsAdmin() bool {
+	return u != nil && u.Role == RoleAdmin
+}
+
+// AuthorizeMiddleware deve ser registrado depois do AuthenticateMiddleware e
+// libera a rota apenas para os papéis informados. Parceiros e entregadores
+// ficam restritos ao próprio :partner_id quando esse parâmetro existe na rota;
+// a posse de recursos de clientes é verificada em cada handler.
+func AuthorizeMiddleware(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		auth_user := getAuthUser(c)
+		if auth_user == nil || !roleAllowed(auth_user.Role, roles) || !canAccessPartnerParam(c, auth_user) {
+			respondForbidden(c)
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+func roleAllowed(role string, roles []string) bool {
+	for _, allowed := range roles {
+		if role == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func canAccessPartnerParam(c *gin.Context, auth_user *AuthUser) bool {
+	if auth_user.Role != RolePartner && auth_user.Role != RoleCourier {
+		return true
+	}
+	partner_id := c.Param("partner_id")
+	return partner_id == "" || partner_id == strconv.Itoa(auth_user.PartnerID)
+}
+
+func (h *Handlers) UpdateUserRole(c *gin.Context) {
+	user_id_str := c.Param("user_id")
+	if user_id_str == "" {
+		c.IndentedJSON(http.StatusBadRequest, "Necessário passar o id do usuário por parâmetro")
+		return
+	}
+
+	user_id, err := primitive.ObjectIDFromHex(user_id_str)
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Formato de ID inválido",
+		})
+		return
+	}
+
+	body := UpdateUserRoleReqBody{}
+	if err := c.ShouldBindBodyWithJSON(&body); err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Não foi possível processar o papel do usuário",
+		})
+		return
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(&body); err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Formulário não está válido",
+		})
+		return
+	}
+
+	if (body.Role == RolePartner || body.Role == RoleCourier) && body.PartnerID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Necessário informar o parceiro para esse papel",
+		})
+		return
+	}
+
+	update_fields := bson.D{
+		{Key: "role", Value: body.Role},
+		{Key: "updated_at", Value: time.Now()},
+	}
+	if body.PartnerID != 0 {
+		update_fields = append(update_fields, bson.E{Key: "partner_id", Value: body.PartnerID})
+	}
+	if body.Role == RoleCourier {
+		update_fields = append(update_fields, bson.E{Key: "delivery_id", Value: body.DeliveryID})
+	}
+
+	collection := h.database.Collection("Users")
+	filter := bson.D{{Key: "_id", Value: user_id}}
+	update := bson.D{{Key: "$set", Value: update_fields}}
+	opts := options.Update().SetUpsert(false)
+	result, err := collection.UpdateOne(h.context, filter, update, opts)
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível atualizar o papel do usuário",
+		})
+		return
+	}
+
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status_code": http.StatusNotFound,
+			"message":     "Usuário não encontrado",
+		})
+		return
+	}
+
+	// Os tokens carregam o papel; o usuário precisa entrar de novo para
+	// receber o novo
+	err = h.revokeSessions(bson.D{{Key: "user_id", Value: user_id}})
+	if err != nil {
+		log.Println("Não foi possível encerrar as sessões após a troca de papel:", err.Error())
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status_code": http.StatusOK,
+		"message":     "Papel do usuário atualizado com sucesso",
+	})
+}
@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sergingroisman/meal-maker-functions/cmd/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ScheduleSlot conta os pedidos agendados de um parceiro em uma faixa de
+// horário. O _id é "<partner_id>:<início da faixa em unix>".
+type ScheduleSlot struct {
+	ID        string    `bson:"_id"`
+	PartnerID int       `bson:"partner_id"`
+	StartsAt  time.Time `bson:"starts_at"`
+	Count     int       `bson:"count"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+// OrderScheduleError é um horário agendado que não pode ser aceito; a
+// mensagem vai na resposta 400.
+type OrderScheduleError struct {
+	Message string
+}
+
+func (e *OrderScheduleError) Error() string {
+	return e.Message
+}
+
+// checkOrderSchedule valida o horário de um pedido agendado: antecedência
+// mínima e máxima e o horário de funcionamento do parceiro.
+func checkOrderSchedule(partner Partner, scheduled_for time.Time, now time.Time) error {
+	min_lead_time := config.Env.Scheduling.MinLeadTime
+	if scheduled_for.Before(now.Add(min_lead_time)) {
+		return &OrderScheduleError{Message: fmt.Sprintf("O pedido agendado precisa de pelo menos %d minutos de antecedência", int(min_lead_time.Minutes()))}
+	}
+	if scheduled_for.After(now.Add(config.Env.Scheduling.MaxAdvance)) {
+		return &OrderScheduleError{Message: "Não é possível agendar o pedido com tanta antecedência"}
+	}
+	if !partner.IsOpen(scheduled_for) {
+		return &OrderScheduleError{Message: "O parceiro não está aberto no horário agendado"}
+	}
+	return nil
+}
+
+// SlotStart devolve o início da faixa de horário de t, com as faixas contadas
+// a partir da meia-noite no fuso do parceiro.
+func (partner *Partner) SlotStart(t time.Time) time.Time {
+	start_of_day, _ := partner.DayRange(t)
+	duration := config.Env.Scheduling.SlotDuration
+	return start_of_day.Add(t.Sub(start_of_day) / duration * duration)
+}
+
+// orderVisibleAt é quando o pedido entra no feed da cozinha: na hora, ou um
+// tempo antes do horário agendado.
+func orderVisibleAt(scheduled_for *time.Time, now time.Time) time.Time {
+	if scheduled_for == nil {
+		return now
+	}
+	visible_at := scheduled_for.Add(-config.Env.Scheduling.FeedLeadTime)
+	if visible_at.Before(now) {
+		return now
+	}
+	return visible_at
+}
+
+// reserveScheduleSlot ocupa uma vaga na faixa do horário agendado e devolve o
+// id da faixa, ou "" quando o parceiro não tem limite. O incremento só casa
+// com faixas abaixo da capacidade; numa faixa cheia o upsert tenta inserir um
+// _id que já existe e falha com chave duplicada.
+func (h *Handlers) reserveScheduleSlot(partner Partner, scheduled_for time.Time) (string, error) {
+	if partner.SlotCapacity <= 0 {
+		return "", nil
+	}
+
+	starts_at := partner.SlotStart(scheduled_for)
+	slot_id := strconv.Itoa(partner.PartnerID) + ":" + strconv.FormatInt(starts_at.Unix(), 10)
+
+	collection := h.database.Collection("ScheduleSlots")
+	filter := bson.D{
+		{Key: "_id", Value: slot_id},
+		{Key: "count", Value: bson.D{{Key: "$lt", Value: partner.SlotCapacity}}},
+	}
+	update := bson.D{
+		{Key: "$inc", Value: bson.D{{Key: "count", Value: 1}}},
+		{Key: "$setOnInsert", Value: bson.D{
+			{Key: "partner_id", Value: partner.PartnerID},
+			{Key: "starts_at", Value: starts_at},
+			{Key: "expires_at", Value: starts_at.Add(config.Env.Scheduling.SlotDuration + 24*time.Hour)},
+		}},
+	}
+	_, err := collection.UpdateOne(h.context, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return "", &OrderScheduleError{Message: "Não há mais vagas para esse horário, escolha outro"}
+	}
+	if err != nil {
+		return "", err
+	}
+	return slot_id, nil
+}
+
+// releaseScheduleSlot devolve a vaga de um pedido agendado que não vai mais
+// ser entregue (cancelado, recusado ou que não chegou a ser gravado).
+func (h *Handlers) releaseScheduleSlot(slot_id string) error {
+	if slot_id == "" {
+		return nil
+	}
+	collection := h.database.Collection("ScheduleSlots")
+	filter := bson.D{
+		{Key: "_id", Value: slot_id},
+		{Key: "count", Value: bson.D{{Key: "$gt", Value: 0}}},
+	}
+	_, err := collection.UpdateOne(h.context, filter, bson.D{{Key: "$inc", Value: bson.D{{Key: "count", Value: -1}}}})
+	return err
+}
+
+// releaseOrderSlot é o releaseScheduleSlot de quem não tem como devolver o
+// erro: uma falha só deixa a faixa com uma vaga a menos.
+func (h *Handlers) releaseOrderSlot(slot_id string) {
+	if err := h.releaseScheduleSlot(slot_id); err != nil {
+		log.Println("Erro ao liberar a vaga do pedido agendado:", err.Error())
+	}
+}
+
+// scheduleOrder valida o horário agendado e reserva a vaga da faixa,
+// respondendo 400 quando o horário não pode ser aceito.
+func (h *Handlers) scheduleOrder(c *gin.Context, partner Partner, scheduled_for time.Time, now time.Time) (string, bool) {
+	slot_id := ""
+	err := checkOrderSchedule(partner, scheduled_for, now)
+	if err == nil {
+		slot_id, err = h.reserveScheduleSlot(partner, scheduled_for)
+	}
+	var schedule_err *OrderScheduleError
+	if errors.As(err, &schedule_err) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     schedule_err.Message,
+		})
+		return "", false
+	}
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível agendar o pedido",
+		})
+		return "", false
+	}
+	return slot_id, true
+}
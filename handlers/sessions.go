@@ -0,0 +1,298 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+	"github.com/sergingroisman/meal-maker-functions/cmd/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Session representa um login ativo. O refresh token nunca é gravado em texto
+// puro, apenas o hash SHA-256 dele.
+type Session struct {
+	ID                  primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	UserID              primitive.ObjectID `bson:"user_id" json:"user_id"`
+	RefreshTokenHash    string             `bson:"refresh_token_hash" json:"-"`
+	PreviousRefreshHash string             `bson:"previous_refresh_hash,omitempty" json:"-"`
+	UserAgent           string             `bson:"user_agent" json:"user_agent"`
+	IP                  string             `bson:"ip" json:"ip"`
+	ExpiresAt           time.Time          `bson:"expires_at" json:"expires_at"`
+	RevokedAt           *time.Time         `bson:"revoked_at,omitempty" json:"revoked_at,omitempty"`
+	CreatedAt           time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt           time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+type RefreshTokenReqBody struct {
+	RefreshToken string `bson:"refresh_token" json:"refresh_token" validate:"required"`
+}
+
+var errSessionNotFound = errors.New("session not found or revoked")
+
+func (h *Handlers) RefreshToken(c *gin.Context) {
+	body := RefreshTokenReqBody{}
+	if err := c.ShouldBindBodyWithJSON(&body); err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Não foi possível processar o refresh token",
+		})
+		return
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(&body); err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Formulário não está válido",
+		})
+		return
+	}
+
+	collection := h.database.Collection("Sessions")
+	token_hash := hashRefreshToken(body.RefreshToken)
+
+	var session Session
+	filter := bson.D{{Key: "refresh_token_hash", Value: token_hash}}
+	err := collection.FindOne(h.context, filter).Decode(&session)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// Um refresh token já rotacionado sendo reutilizado indica vazamento:
+		// a sessão inteira é revogada.
+		reuse_filter := bson.D{{Key: "previous_refresh_hash", Value: token_hash}}
+		if err := collection.FindOne(h.context, reuse_filter).Decode(&session); err == nil {
+			log.Printf("Reuso de refresh token detectado na sessão %s", session.ID.Hex())
+			h.revokeSessions(bson.D{{Key: "_id", Value: session.ID}})
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"status_code": http.StatusUnauthorized,
+			"message":     "Refresh token inválido",
+		})
+		return
+	}
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível validar o refresh token",
+		})
+		return
+	}
+
+	if session.RevokedAt != nil || time.Now().After(session.ExpiresAt) {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"status_code": http.StatusUnauthorized,
+			"message":     "Sessão expirada, faça o login novamente",
+		})
+		return
+	}
+
+	var user User
+	collectionU := h.database.Collection("Users")
+	err = collectionU.FindOne(h.context, bson.D{{Key: "_id", Value: session.UserID}}).Decode(&user)
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"status_code": http.StatusUnauthorized,
+			"message":     "Não foi possível encontrar o usuário dessa sessão",
+		})
+		return
+	}
+
+	refresh_token, err := newRefreshToken()
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível criar um token de acesso",
+		})
+		return
+	}
+
+	// O filtro pelo hash atual garante que duas rotações concorrentes do mesmo
+	// token não gerem dois refresh tokens válidos.
+	rotate_filter := bson.D{
+		{Key: "_id", Value: session.ID},
+		{Key: "refresh_token_hash", Value: token_hash},
+		{Key: "revoked_at", Value: bson.D{{Key: "$exists", Value: false}}},
+	}
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "refresh_token_hash", Value: hashRefreshToken(refresh_token)},
+		{Key: "previous_refresh_hash", Value: token_hash},
+		{Key: "updated_at", Value: time.Now()},
+	}}}
+	result, err := collection.UpdateOne(h.context, rotate_filter, update)
+	if err != nil || result.ModifiedCount == 0 {
+		if err != nil {
+			log.Println(err.Error())
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"status_code": http.StatusUnauthorized,
+			"message":     "Refresh token inválido",
+		})
+		return
+	}
+
+	res, err := buildSignInResponse(user, session, refresh_token)
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível criar um token de acesso",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status_code": http.StatusOK,
+		"loggedIn":    res,
+	})
+}
+
+func (h *Handlers) SignOut(c *gin.Context) {
+	auth_user := getAuthUser(c)
+	session_id, err := primitive.ObjectIDFromHex(auth_user.SessionID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Sessão inválida",
+		})
+		return
+	}
+
+	err = h.revokeSessions(bson.D{{Key: "_id", Value: session_id}})
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível encerrar a sessão",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status_code": http.StatusOK,
+		"message":     "Sessão encerrada com sucesso",
+	})
+}
+
+func (h *Handlers) SignOutAllDevices(c *gin.Context) {
+	auth_user := getAuthUser(c)
+	err := h.revokeSessions(bson.D{{Key: "user_id", Value: auth_user.ID}})
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível encerrar as sessões",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status_code": http.StatusOK,
+		"message":     "Todas as sessões foram encerradas com sucesso",
+	})
+}
+
+// startSession grava uma nova sessão para o usuário e devolve o par
+// access token / refresh token.
+func (h *Handlers) startSession(c *gin.Context, user User) (SignInResponse, error) {
+	refresh_token, err := newRefreshToken()
+	if err != nil {
+		return SignInResponse{}, err
+	}
+
+	session := Session{
+		ID:               primitive.NewObjectID(),
+		UserID:           user.ID,
+		RefreshTokenHash: hashRefreshToken(refresh_token),
+		UserAgent:        c.Request.UserAgent(),
+		IP:               c.ClientIP(),
+		ExpiresAt:        time.Now().Add(config.Env.Auth.RefreshTokenTTL),
+		CreatedAt:        time.Now(),
+		UpdatedAt:        time.Now(),
+	}
+
+	collection := h.database.Collection("Sessions")
+	_, err = collection.InsertOne(h.context, session)
+	if err != nil {
+		return SignInResponse{}, err
+	}
+
+	return buildSignInResponse(user, session, refresh_token)
+}
+
+// sessionIsActive é usado pelo AuthenticateMiddleware para recusar tokens de
+// sessões revogadas ou expiradas.
+func (h *Handlers) sessionIsActive(session_id_str string) error {
+	session_id, err := primitive.ObjectIDFromHex(session_id_str)
+	if err != nil {
+		return errSessionNotFound
+	}
+
+	collection := h.database.Collection("Sessions")
+	filter := bson.D{
+		{Key: "_id", Value: session_id},
+		{Key: "revoked_at", Value: bson.D{{Key: "$exists", Value: false}}},
+		{Key: "expires_at", Value: bson.D{{Key: "$gt", Value: time.Now()}}},
+	}
+	err = collection.FindOne(h.context, filter).Err()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return errSessionNotFound
+	}
+	return err
+}
+
+func (h *Handlers) revokeSessions(filter bson.D) error {
+	filter = append(filter, bson.E{Key: "revoked_at", Value: bson.D{{Key: "$exists", Value: false}}})
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "revoked_at", Value: time.Now()},
+		{Key: "updated_at", Value: time.Now()},
+	}}}
+
+	collection := h.database.Collection("Sessions")
+	_, err := collection.UpdateMany(h.context, filter, update)
+	return err
+}
+
+func buildSignInResponse(user User, session Session, refresh_token string) (SignInResponse, error) {
+	token, err := createToken(user, session.ID.Hex())
+	if err != nil {
+		return SignInResponse{}, err
+	}
+
+	return SignInResponse{
+		ID:               user.ID,
+		Accesstoken:      "Bearer " + token,
+		RefreshToken:     refresh_token,
+		Name:             user.Name,
+		PartnerID:        user.PartnerID,
+		Role:             getRole(user),
+		PhoneNumber:      user.PhoneNumber,
+		ExpiresIn:        int64(config.Env.Auth.AccessTokenTTL.Seconds()),
+		RefreshExpiresIn: int64(time.Until(session.ExpiresAt).Seconds()),
+	}, nil
+}
+
+func newRefreshToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,257 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sergingroisman/meal-maker-functions/cmd/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// CourierContact é o que o cliente vê do entregador no acompanhamento.
+type CourierContact struct {
+	Name        string `json:"name"`
+	PhoneNumber string `json:"phone_number"`
+}
+
+// trackingToken gera o token do link público de acompanhamento:
+// "<id do pedido>.<hmac>". Sem a chave do servidor não dá para montar o token
+// de outro pedido.
+func trackingToken(order_id int) string {
+	id := strconv.Itoa(order_id)
+	return id + "." + trackingSignature(id)
+}
+
+func trackingSignature(order_id string) string {
+	mac := hmac.New(sha256.New, []byte(config.Env.Auth.SecretKey))
+	mac.Write([]byte("order-tracking:" + order_id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:18])
+}
+
+func parseTrackingToken(token string) (int, bool) {
+	id, signature, found := strings.Cut(token, ".")
+	if !found {
+		return 0, false
+	}
+	if !hmac.Equal([]byte(signature), []byte(trackingSignature(id))) {
+		return 0, false
+	}
+	order_id, err := strconv.Atoi(id)
+	if err != nil {
+		return 0, false
+	}
+	return order_id, true
+}
+
+func trackingURL(token string) string {
+	if config.Env.Tracking.URL == "" {
+		return ""
+	}
+	return strings.TrimSuffix(config.Env.Tracking.URL, "/") + "/" + token
+}
+
+// trackingLinkExpired indica se o link público já venceu. O link vale até um
+// tempo depois do pedido ser entregue, cancelado ou recusado.
+func trackingLinkExpired(order Order) bool {
+	switch order.Status {
+	case OrderDelivered, OrderCancelled, OrderRejected:
+	default:
+		return false
+	}
+	history := order.StatusHistory
+	if len(history) == 0 {
+		return true
+	}
+	finished_at := history[len(history)-1].ChangedAt
+	return time.Since(finished_at) > config.Env.Tracking.LinkTTLAfterDelivery
+}
+
+func (h *Handlers) findCourierContact(delivery_id int) *CourierContact {
+	if delivery_id == 0 {
+		return nil
+	}
+	var delivery Delivery
+	collection := h.database.Collection("Deliveries")
+	err := collection.FindOne(h.context, bson.D{{Key: "_id", Value: delivery_id}}).Decode(&delivery)
+	if err != nil {
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			log.Println(err.Error())
+		}
+		return nil
+	}
+	return &CourierContact{Name: delivery.Name, PhoneNumber: delivery.PhoneNumber}
+}
+
+func (h *Handlers) orderTrackingSnapshot(order Order, at time.Time) OrderEvent {
+	event := OrderEvent{
+		Type:        OrderEventSnapshot,
+		OrderID:     order.ID,
+		Status:      order.Status,
+		Description: order.Status.String(),
+		History:     publicStatusHistory(order.StatusHistory),
+		Courier:     h.findCourierContact(order.DeliveryID),
+		At:          at,
+	}
+	event.ID = orderEventID(at, "")
+	return event
+}
+
+// publicStatusChange tira da mudança de status quem a fez: o link público não
+// deve expor o id do cliente nem da equipe do parceiro.
+func publicStatusChange(change StatusChange) StatusChange {
+	change.Actor = ""
+	change.ActorID = ""
+	return change
+}
+
+func publicStatusHistory(history []StatusChange) []StatusChange {
+	if history == nil {
+		return nil
+	}
+	public := make([]StatusChange, 0, len(history))
+	for _, change := range history {
+		public = append(public, publicStatusChange(change))
+	}
+	return public
+}
+
+// trackingView tira do evento os dados do pedido que o acompanhamento não
+// precisa (endereço, telefone do cliente, quem mudou o status) e inclui o
+// entregador atribuído.
+func (h *Handlers) trackingView() func(OrderEvent) OrderEvent {
+	couriers := map[int]*CourierContact{}
+	return func(event OrderEvent) OrderEvent {
+		event.Order = nil
+		event.History = publicStatusHistory(event.History)
+		if event.Change != nil {
+			change := publicStatusChange(*event.Change)
+			event.Change = &change
+		}
+		if event.deliveryID == 0 {
+			return event
+		}
+		courier, cached := couriers[event.deliveryID]
+		if !cached {
+			courier = h.findCourierContact(event.deliveryID)
+			couriers[event.deliveryID] = courier
+		}
+		event.Courier = courier
+		return event
+	}
+}
+
+func (h *Handlers) findTrackedOrder(c *gin.Context) (Order, bool) {
+	var order Order
+	order_id, ok := parseTrackingToken(c.Param("token"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status_code": http.StatusNotFound,
+			"message":     "Link de acompanhamento inválido",
+		})
+		return order, false
+	}
+
+	collection := h.database.Collection("Orders")
+	err := collection.FindOne(h.context, bson.D{{Key: "_id", Value: order_id}}).Decode(&order)
+	if err != nil {
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			log.Println(err.Error())
+		}
+		c.JSON(http.StatusNotFound, gin.H{
+			"status_code": http.StatusNotFound,
+			"message":     "Link de acompanhamento inválido",
+		})
+		return order, false
+	}
+
+	if trackingLinkExpired(order) {
+		c.JSON(http.StatusGone, gin.H{
+			"status_code": http.StatusGone,
+			"message":     "Link de acompanhamento expirado",
+		})
+		return order, false
+	}
+	return order, true
+}
+
+// GetOrderTrackingLink devolve o link público do pedido para ser compartilhado
+// (por exemplo, pelo WhatsApp) com quem não tem login.
+func (h *Handlers) GetOrderTrackingLink(c *gin.Context) {
+	order_id, err := strconv.Atoi(c.Param("order_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Formato de ID inválido",
+		})
+		return
+	}
+
+	order, ok := h.findScopedOrder(c, order_id)
+	if !ok {
+		return
+	}
+	if trackingLinkExpired(order) {
+		c.JSON(http.StatusGone, gin.H{
+			"status_code": http.StatusGone,
+			"message":     "O acompanhamento desse pedido já foi encerrado",
+		})
+		return
+	}
+
+	token := trackingToken(order.ID)
+	c.JSON(http.StatusOK, gin.H{
+		"status_code": http.StatusOK,
+		"token":       token,
+		"url":         trackingURL(token),
+	})
+}
+
+// GetOrderTracking é a consulta pública, pelo token, do status do pedido.
+func (h *Handlers) GetOrderTracking(c *gin.Context) {
+	at := time.Now()
+	order, ok := h.findTrackedOrder(c)
+	if !ok {
+		return
+	}
+	c.IndentedJSON(http.StatusOK, h.orderTrackingSnapshot(order, at))
+}
+
+// StreamOrderTracking é o stream SSE público, pelo token, do pedido.
+func (h *Handlers) StreamOrderTracking(c *gin.Context) {
+	at := time.Now()
+	order, ok := h.findTrackedOrder(c)
+	if !ok {
+		return
+	}
+	snapshot := h.orderTrackingSnapshot(order, at)
+	h.streamOrderEvents(c, bson.D{{Key: "_id", Value: order.ID}}, &snapshot, h.trackingView(), false)
+}
+
+// StreamOrderByID é o stream SSE do pedido para o cliente logado.
+func (h *Handlers) StreamOrderByID(c *gin.Context) {
+	order_id, err := strconv.Atoi(c.Param("order_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Formato de ID inválido",
+		})
+		return
+	}
+
+	at := time.Now()
+	order, ok := h.findScopedOrder(c, order_id)
+	if !ok {
+		return
+	}
+	snapshot := h.orderTrackingSnapshot(order, at)
+	h.streamOrderEvents(c, bson.D{{Key: "_id", Value: order.ID}}, &snapshot, h.trackingView(), false)
+}
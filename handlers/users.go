@@ -1,11 +1,9 @@
 package handlers
 
 import (
-	"encoding/base64"
 	"fmt"
 	"log"
 	"net/http"
-	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -27,22 +25,26 @@ type Address struct {
 }
 
 type User struct {
-	ID          primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
-	Name        string             `bson:"name" json:"name"`
-	PhoneNumber string             `bson:"phone_number" json:"phone_number"`
-	Password    string             `bson:"password" json:"password"`
-	PartnerID   int                `bson:"partner_id" json:"partner_id"`
-	Address     Address            `bson:"address" json:"address"`
-	Role        string             `bson:"role" json:"role"`
-	CreatedAt   string             `bson:"created_at" json:"created_at"`
-	UpdatedAt   string             `bson:"updated_at" json:"updated_at"`
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
+	Name          string             `bson:"name" json:"name"`
+	PhoneNumber   string             `bson:"phone_number" json:"phone_number"`
+	PhoneVerified bool               `bson:"phone_verified" json:"phone_verified"`
+	Password      string             `bson:"password" json:"-"`
+	PartnerID     int                `bson:"partner_id" json:"partner_id"`
+	Address       Address            `bson:"address" json:"address"`
+	Addresses     []UserAddress      `bson:"addresses,omitempty" json:"addresses,omitempty"`
+	Role          string             `bson:"role" json:"role"`
+	DeliveryID    int                `bson:"delivery_id,omitempty" json:"delivery_id,omitempty"`
+	CreatedAt     time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt     time.Time          `bson:"updated_at" json:"updated_at"`
 }
 
 type SignUpReqBody struct {
-	Name        string  `bson:"name" json:"name" validate:"required"`
-	PhoneNumber string  `bson:"phone_number" json:"phone_number" validate:"required"`
-	Password    string  `bson:"password" json:"password" validate:"required,min=6"`
-	Address     Address `bson:"address" json:"address"`
+	Name              string  `bson:"name" json:"name" validate:"required"`
+	PhoneNumber       string  `bson:"phone_number" json:"phone_number" validate:"required"`
+	Password          string  `bson:"password" json:"password" validate:"required,min=6"`
+	Address           Address `bson:"address" json:"address"`
+	VerificationToken string  `bson:"verification_token" json:"verification_token"`
 }
 
 type SignInReqBody struct {
@@ -56,13 +58,15 @@ type UpdatePasswordReqBody struct {
 }
 
 type SignInResponse struct {
-	ID          primitive.ObjectID `json:"_id"`
-	Accesstoken string             `json:"access_token"`
-	Name        string             `json:"name"`
-	PhoneNumber string             `json:"phone_number"`
-	Role        string             `json:"role"`
-	PartnerID   int                `json:"partner_id"`
-	ExpiresIn   time.Duration      `json:"expires_in"`
+	ID               primitive.ObjectID `json:"_id"`
+	Accesstoken      string             `json:"access_token"`
+	RefreshToken     string             `json:"refresh_token"`
+	Name             string             `json:"name"`
+	PhoneNumber      string             `json:"phone_number"`
+	Role             string             `json:"role"`
+	PartnerID        int                `json:"partner_id"`
+	ExpiresIn        int64              `json:"expires_in"`
+	RefreshExpiresIn int64              `json:"refresh_expires_in"`
 }
 
 func (h *Handlers) GetUsers(c *gin.Context) {
@@ -92,24 +96,14 @@ func (h *Handlers) GetUsers(c *gin.Context) {
 
 func (h *Handlers) GetUserById(c *gin.Context) {
 	var user User
-	user_id_str := c.Param("user_id")
-	if user_id_str == "" {
-		c.IndentedJSON(http.StatusBadRequest, "Necessário passar id do cardápio por parâmetro")
-		return
-	}
-	user_id, err := primitive.ObjectIDFromHex(user_id_str)
-	if err != nil {
-		log.Println(err.Error())
-		c.JSON(http.StatusBadRequest, gin.H{
-			"status_code": http.StatusBadRequest,
-			"message":     "Formato de ID inválido",
-		})
+	user_id, ok := resolveUserID(c)
+	if !ok {
 		return
 	}
 
 	collection := h.database.Collection("Users")
 	filter := bson.D{{Key: "_id", Value: user_id}}
-	err = collection.FindOne(h.context, filter).Decode(&user)
+	err := collection.FindOne(h.context, filter).Decode(&user)
 
 	if err != nil {
 		log.Println(err.Error())
@@ -144,9 +138,18 @@ func (h *Handlers) SignUp(c *gin.Context) {
 		return
 	}
 
+	phone_number, ok := normalizePhoneNumber(body.PhoneNumber)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Número de telefone inválido",
+		})
+		return
+	}
+
 	var user User
 	collection := h.database.Collection("Users")
-	filter_user_by_phone_number := bson.D{{Key: "phone_number", Value: body.PhoneNumber}}
+	filter_user_by_phone_number := bson.D{{Key: "phone_number", Value: phone_number}}
 
 	err := collection.FindOne(h.context, filter_user_by_phone_number).Decode(&user)
 	if err != nil {
@@ -161,13 +164,41 @@ func (h *Handlers) SignUp(c *gin.Context) {
 		return
 	}
 
-	password_encoded := passwordEncodeB64(body.Password)
+	phone_verified := false
+	if body.VerificationToken != "" {
+		if err := h.consumeVerificationToken(phone_number, body.VerificationToken); err != nil {
+			respondOTPError(c, err)
+			return
+		}
+		phone_verified = true
+	}
+
+	if config.Env.OTP.RequiredOnSignUp && !phone_verified {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status_code": http.StatusBadRequest,
+			"message":     "Necessário verificar o número de telefone antes do cadastro",
+		})
+		return
+	}
+
+	hashed_password, err := h.hasher.Hash(body.Password)
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Usuário não foi cadastrado com sucesso",
+		})
+		return
+	}
+
 	user = User{
-		ID:          primitive.NewObjectID(),
-		Name:        body.Name,
-		PhoneNumber: body.PhoneNumber,
-		Password:    password_encoded,
-		PartnerID:   1,
+		ID:            primitive.NewObjectID(),
+		Name:          body.Name,
+		PhoneNumber:   phone_number,
+		PhoneVerified: phone_verified,
+		Password:      hashed_password,
+		PartnerID:     1,
+		Role:          RoleClient,
 		Address: Address{
 			CEP:        body.Address.CEP,
 			City:       body.Address.City,
@@ -176,8 +207,8 @@ func (h *Handlers) SignUp(c *gin.Context) {
 			State:      body.Address.State,
 			Street:     body.Address.Street,
 		},
-		CreatedAt: time.Now().String(),
-		UpdatedAt: time.Now().String(),
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
 	}
 
 	_, err = collection.InsertOne(h.context, user)
@@ -190,22 +221,21 @@ func (h *Handlers) SignUp(c *gin.Context) {
 		return
 	}
 
-	var bearer_token strings.Builder
-	bearer_token.WriteString("Bearer ")
-	token, err := createToken(user.PhoneNumber)
+	res, err := h.startSession(c, user)
 	if err != nil {
+		log.Println(err.Error())
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status_code": http.StatusBadRequest,
 			"message":     "Não foi possível criar um token de acesso",
 		})
 		return
 	}
-	bearer_token.WriteString(token)
 
 	c.JSON(http.StatusOK, gin.H{
-		"status_code": http.StatusOK,
-		"user":        user,
-		"accessToken": bearer_token.String(),
+		"status_code":  http.StatusOK,
+		"user":         user,
+		"accessToken":  res.Accesstoken,
+		"refreshToken": res.RefreshToken,
 	})
 }
 
@@ -230,13 +260,23 @@ func (h *Handlers) SignIn(c *gin.Context) {
 		return
 	}
 
+	phone_number, ok := normalizePhoneNumber(body.PhoneNumber)
+	if !ok {
+		phone_number = body.PhoneNumber
+	}
+
+	if !h.checkAuthLockout(c, phone_number) {
+		return
+	}
+
 	var user User
-	filter_user_by_phone_number := bson.D{{Key: "phone_number", Value: body.PhoneNumber}}
+	filter_user_by_phone_number := bson.D{{Key: "phone_number", Value: phone_number}}
 	collection := h.database.Collection("Users")
 
 	err := collection.FindOne(h.context, filter_user_by_phone_number).Decode(&user)
 	if err != nil {
 		log.Println(err.Error())
+		h.registerAuthFailure(c, phone_number)
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status_code": http.StatusBadRequest,
 			"message":     "Não foi possível encontrar esse usuário pelo número de telefone",
@@ -244,18 +284,20 @@ func (h *Handlers) SignIn(c *gin.Context) {
 		return
 	}
 
-	if !passwordsMatch(user.Password, body.Password) {
+	if !h.comparePassword(user.Password, body.Password) {
+		h.registerAuthFailure(c, phone_number)
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status_code": http.StatusBadRequest,
 			"message":     "Não foi possível realizar o login com essa combinação de senha",
 		})
 		return
 	}
+	h.clearAuthFailures(phone_number)
+	h.rehashPasswordIfNeeded(user, body.Password)
 
-	var bearer_token strings.Builder
-	bearer_token.WriteString("Bearer ")
-	token, err := createToken(user.PhoneNumber)
+	res, err := h.startSession(c, user)
 	if err != nil {
+		log.Println(err.Error())
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status_code": http.StatusBadRequest,
 			"message":     "Não foi possível criar um token de acesso",
@@ -263,17 +305,6 @@ func (h *Handlers) SignIn(c *gin.Context) {
 		return
 	}
 
-	bearer_token.WriteString(token)
-	res := SignInResponse{
-		ID:          user.ID,
-		Accesstoken: bearer_token.String(),
-		Name:        user.Name,
-		PartnerID:   1,
-		Role:        user.Role,
-		PhoneNumber: user.PhoneNumber,
-		ExpiresIn:   (time.Duration(30*24) * time.Hour),
-	}
-
 	c.JSON(http.StatusOK, gin.H{
 		"status_code": http.StatusOK,
 		"loggedIn":    res,
@@ -282,9 +313,8 @@ func (h *Handlers) SignIn(c *gin.Context) {
 
 func (h *Handlers) UpdateUserAddress(c *gin.Context) {
 	body := Address{}
-	user_id_str := c.Param("user_id")
-	if user_id_str == "" {
-		c.IndentedJSON(http.StatusBadRequest, "Necessário passar o número de telefone como parâmetro")
+	user_id, ok := resolveUserID(c)
+	if !ok {
 		return
 	}
 
@@ -307,20 +337,10 @@ func (h *Handlers) UpdateUserAddress(c *gin.Context) {
 		return
 	}
 
-	user_id, err := primitive.ObjectIDFromHex(user_id_str)
-	if err != nil {
-		log.Println(err.Error())
-		c.JSON(http.StatusBadRequest, gin.H{
-			"status_code": http.StatusBadRequest,
-			"message":     "Formato de ID inválido",
-		})
-		return
-	}
-
 	var user User
 	filter_user_by_id := bson.D{{Key: "_id", Value: user_id}}
 	collection := h.database.Collection("Users")
-	err = collection.FindOne(h.context, filter_user_by_id).Decode(&user)
+	err := collection.FindOne(h.context, filter_user_by_id).Decode(&user)
 	if err != nil {
 		log.Println(err.Error())
 		c.JSON(http.StatusBadRequest, gin.H{
@@ -331,16 +351,33 @@ func (h *Handlers) UpdateUserAddress(c *gin.Context) {
 	}
 
 	filter := bson.D{{Key: "_id", Value: user.ID}}
-	update := bson.D{{Key: "$set", Value: bson.D{
+	update_fields := bson.D{
 		{Key: "address.street", Value: body.Street},
 		{Key: "address.number", Value: body.Number},
 		{Key: "address.city", Value: body.City},
 		{Key: "address.cep", Value: body.CEP},
 		{Key: "address.state", Value: body.State},
 		{Key: "address.complement", Value: body.Complement},
-		{Key: "updated_at", Value: time.Now().String()},
-	}}}
+		{Key: "updated_at", Value: time.Now()},
+	}
 	opts := options.Update().SetUpsert(false)
+
+	// O endereço padrão do caderno de endereços acompanha o endereço principal
+	if len(user.Addresses) > 0 {
+		update_fields = append(update_fields,
+			bson.E{Key: "addresses.$[default].street", Value: body.Street},
+			bson.E{Key: "addresses.$[default].number", Value: body.Number},
+			bson.E{Key: "addresses.$[default].city", Value: body.City},
+			bson.E{Key: "addresses.$[default].cep", Value: body.CEP},
+			bson.E{Key: "addresses.$[default].state", Value: body.State},
+			bson.E{Key: "addresses.$[default].complement", Value: body.Complement},
+		)
+		opts.SetArrayFilters(options.ArrayFilters{Filters: []interface{}{
+			bson.D{{Key: "default.is_default", Value: true}},
+		}})
+	}
+
+	update := bson.D{{Key: "$set", Value: update_fields}}
 	_, err = collection.UpdateOne(h.context, filter, update, opts)
 	if err != nil {
 		log.Println(err.Error())
@@ -359,9 +396,8 @@ func (h *Handlers) UpdateUserAddress(c *gin.Context) {
 
 func (h *Handlers) UpdatePassword(c *gin.Context) {
 	body := UpdatePasswordReqBody{}
-	phone_number := c.Param("phone_number")
-	if phone_number == "" {
-		c.IndentedJSON(http.StatusBadRequest, "Necessário passar o número de telefone como parâmetro")
+	phone_number, ok := resolvePhoneNumber(c)
+	if !ok {
 		return
 	}
 
@@ -384,6 +420,10 @@ func (h *Handlers) UpdatePassword(c *gin.Context) {
 		return
 	}
 
+	if !h.checkAuthLockout(c, phone_number) {
+		return
+	}
+
 	var user User
 	filter_user_by_phone_number := bson.D{{Key: "phone_number", Value: phone_number}}
 	collection := h.database.Collection("Users")
@@ -397,17 +437,29 @@ func (h *Handlers) UpdatePassword(c *gin.Context) {
 		return
 	}
 
-	if !passwordsMatch(user.Password, body.Password) {
+	if !h.comparePassword(user.Password, body.Password) {
+		h.registerAuthFailure(c, phone_number)
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status_code": http.StatusBadRequest,
 			"message":     "Não foi possível realizar o login com essa combinação de senha",
 		})
 		return
 	}
+	h.clearAuthFailures(phone_number)
+
+	hashed_password, err := h.hasher.Hash(body.NewPassword)
+	if err != nil {
+		log.Println(err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"status_code": http.StatusInternalServerError,
+			"message":     "Não foi possível atualizar a senha",
+		})
+		return
+	}
 	filter := bson.D{{Key: "_id", Value: user.ID}}
 	update := bson.D{{Key: "$set", Value: bson.D{
-		{Key: "password", Value: passwordEncodeB64(body.NewPassword)},
-		{Key: "updated_at", Value: time.Now().String()},
+		{Key: "password", Value: hashed_password},
+		{Key: "updated_at", Value: time.Now()},
 	}}}
 	opts := options.Update().SetUpsert(false)
 	_, err = collection.UpdateOne(h.context, filter, update, opts)
@@ -426,11 +478,12 @@ func (h *Handlers) UpdatePassword(c *gin.Context) {
 	})
 }
 
-func verifyToken(token_string string) (*jwt.Token, error) {
+func verifyToken(token_string string) (*AuthClaims, error) {
 	var SECRET = []byte(config.Env.Auth.SecretKey)
-	token, err := jwt.Parse(token_string, func(token *jwt.Token) (interface{}, error) {
+	claims := &AuthClaims{}
+	token, err := jwt.ParseWithClaims(token_string, claims, func(token *jwt.Token) (interface{}, error) {
 		return SECRET, nil
-	})
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithIssuer(tokenIssuer))
 	if err != nil {
 		return nil, err
 	}
@@ -439,28 +492,24 @@ func verifyToken(token_string string) (*jwt.Token, error) {
 		return nil, fmt.Errorf("invalid token")
 	}
 
-	return token, nil
+	return claims, nil
 }
 
-func passwordEncodeB64(password string) string {
-	password_encoded := base64.StdEncoding.EncodeToString([]byte(password))
-	return password_encoded
-}
-
-func passwordsMatch(hashed_password, password string) bool {
-	password_encoded := passwordEncodeB64(password)
-	return hashed_password == password_encoded
-}
-
-func createToken(phone_number string) (string, error) {
+func createToken(user User, session_id string) (string, error) {
 	var SECRET = []byte(config.Env.Auth.SecretKey)
 
-	claims := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"sub": phone_number,
-		"iss": "meal-maker-functions",
-		"aud": getRole(),
-		"exp": time.Now().Add(time.Hour).Unix(),
-		"iat": time.Now().Unix(),
+	claims := jwt.NewWithClaims(jwt.SigningMethodHS256, AuthClaims{
+		PhoneNumber: user.PhoneNumber,
+		Role:        getRole(user),
+		PartnerID:   user.PartnerID,
+		DeliveryID:  user.DeliveryID,
+		SessionID:   session_id,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   user.ID.Hex(),
+			Issuer:    tokenIssuer,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(config.Env.Auth.AccessTokenTTL)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
 	})
 
 	token_string, err := claims.SignedString(SECRET)
@@ -471,9 +520,9 @@ func createToken(phone_number string) (string, error) {
 	return token_string, nil
 }
 
-func getRole() string {
-	// if username == "admin" {
-	// 	return "admin"
-	// }
-	return "client"
+func getRole(user User) string {
+	if !isValidRole(user.Role) {
+		return RoleClient
+	}
+	return user.Role
 }